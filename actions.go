@@ -0,0 +1,132 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	actionDiscard = "discard"
+	actionApply   = "apply"
+)
+
+// readRunID reads the ID of the run fetched by a previous get of this resource, from the directory given in run
+func (r *Resource) readRunID(input inputJSON) (string, error) {
+	byteVal, err := os.ReadFile(path.Join(r.WorkingDirectory, input.Params.Run, "run_id"))
+	if err != nil {
+		return "", formatError(err, "reading run ID")
+	}
+	return strings.TrimSpace(string(byteVal)), nil
+}
+
+// readRunMetadata reads the metadata.json written by a previous get of this resource
+func (r *Resource) readRunMetadata(input inputJSON) (map[string]string, error) {
+	var metadata map[string]string
+	byteVal, err := os.ReadFile(path.Join(r.WorkingDirectory, input.Params.Run, "metadata.json"))
+	if err == nil {
+		err = json.Unmarshal(byteVal, &metadata)
+	}
+	if err != nil {
+		return nil, formatError(err, "reading run metadata")
+	}
+	return metadata, nil
+}
+
+// checkRunWorkspace makes sure a run read from a previous get belongs to this resource's workspace, so a put can't act
+// on some other workspace's run
+func (r *Resource) checkRunWorkspace(run *tfe.Run, doing string) error {
+	if run.Workspace == nil || run.Workspace.ID != r.Workspace.ID {
+		return fmt.Errorf("error %s: run %s doesn't belong to workspace %s", doing, run.ID, r.Workspace.ID)
+	}
+	return nil
+}
+
+// apply confirms the run fetched by a previous get, as long as it's still in the state it was in then
+func (r *Resource) apply(input inputJSON) ([]byte, error) {
+	runID, err := r.readRunID(input)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := r.readRunMetadata(input)
+	if err != nil {
+		return nil, err
+	}
+	run, err := r.Client.Runs.Read(r.Context, runID)
+	if err != nil {
+		return nil, formatError(err, "retrieving run")
+	}
+	if err := r.checkRunWorkspace(run, "applying run"); err != nil {
+		return nil, err
+	}
+	if string(run.Status) != metadata["final_status"] {
+		return nil, fmt.Errorf("error applying run: run %s has changed status since it was fetched (was %s, now %s)",
+			run.ID, metadata["final_status"], run.Status)
+	}
+	if run.Actions == nil || !run.Actions.IsConfirmable {
+		return nil, fmt.Errorf("error applying run: run %s can't be confirmed (status = %s)", run.ID, run.Status)
+	}
+	if err := r.checkCostDelta(input, run); err != nil {
+		return nil, err
+	}
+	if err := r.checkGuardrails(input, run); err != nil {
+		return nil, err
+	}
+
+	err = r.Client.Runs.Apply(r.Context, run.ID, tfe.RunApplyOptions{Comment: &input.Params.ApplyMessage})
+	if err != nil {
+		return nil, formatError(err, "applying run")
+	}
+	if run, err = r.Client.Runs.Read(r.Context, runID); err != nil {
+		return nil, formatError(err, "retrieving run")
+	}
+
+	v, err := r.readVersion(input, run)
+	if err != nil {
+		return nil, err
+	}
+	result := outOutputJSON{
+		Version:  v,
+		Metadata: runMetadata(input, run),
+	}
+	return json.Marshal(result)
+}
+
+func (r *Resource) discard(input inputJSON) ([]byte, error) {
+	runID, err := r.readRunID(input)
+	if err != nil {
+		return nil, err
+	}
+	run, err := r.Client.Runs.Read(r.Context, runID)
+	if err != nil {
+		return nil, formatError(err, "retrieving run")
+	}
+	if err := r.checkRunWorkspace(run, "discarding run"); err != nil {
+		return nil, err
+	}
+	if run.Actions == nil || !run.Actions.IsDiscardable {
+		return nil, fmt.Errorf("error discarding run: run %s can't be discarded (status = %s)", run.ID, run.Status)
+	}
+
+	comment := input.Params.DiscardMessage
+	err = r.Client.Runs.Discard(r.Context, run.ID, tfe.RunDiscardOptions{Comment: &comment})
+	if err != nil {
+		return nil, formatError(err, "discarding run")
+	}
+	if run, err = r.Client.Runs.Read(r.Context, runID); err != nil {
+		return nil, formatError(err, "retrieving run")
+	}
+
+	v, err := r.readVersion(input, run)
+	if err != nil {
+		return nil, err
+	}
+	result := outOutputJSON{
+		Version:  v,
+		Metadata: append(runMetadata(input, run), versionMetadata{Value: comment, Name: "discard_message"}),
+	}
+	return json.Marshal(result)
+}
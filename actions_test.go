@@ -0,0 +1,217 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDiscard(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := path.Join(wd, "test_output", "test_discard")
+	_ = os.MkdirAll(path.Join(dir, "plan"), os.FileMode(0755))
+	_ = os.WriteFile(path.Join(dir, "plan", "run_id"), []byte("run-123\n"), os.FileMode(0644))
+
+	input := inputJSON{Params: paramsJSON{
+		Action:         actionDiscard,
+		Run:            "plan",
+		DiscardMessage: "Rejected in approval",
+	}}
+
+	t.Run("discards the run", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.ID = "run-123"
+		run.Status = tfe.RunPlanned
+		run.Actions = &tfe.RunActions{IsDiscardable: true}
+		discarded := run
+		discarded.Status = tfe.RunDiscarded
+		gomock.InOrder(
+			r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil),
+			r.runs.EXPECT().Discard(gomock.Any(), "run-123", tfe.RunDiscardOptions{
+				Comment: tfe.String("Rejected in approval"),
+			}).Return(nil),
+			r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&discarded, nil),
+		)
+
+		byteVal, err := r.out(input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var result outOutputJSON
+		_ = json.Unmarshal(byteVal, &result)
+		if result.Version.Ref != "run-123" {
+			t.Errorf("unexpected version %s", result.Version.Ref)
+		}
+		metadata := make(map[string]string)
+		for _, m := range result.Metadata {
+			metadata[m.Name] = m.Value
+		}
+		if metadata["final_status"] != "discarded" || metadata["discard_message"] != "Rejected in approval" {
+			t.Errorf("discard wasn't recorded in metadata: %v", metadata)
+		}
+	})
+	t.Run("run can't be discarded", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Status = tfe.RunApplied
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		if _, err := r.out(input); didntErrorWithSubstr(err, "can't be discarded (status = applied)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("run from another workspace", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.ID = "run-123"
+		run.Actions = &tfe.RunActions{IsDiscardable: true}
+		run.Workspace = &tfe.Workspace{ID: "other"}
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		if _, err := r.out(input); didntErrorWithSubstr(err,
+			"error discarding run: run run-123 doesn't belong to workspace foo") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error discarding", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Actions = &tfe.RunActions{IsDiscardable: true}
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("NO"))
+		if _, err := r.out(input); didntErrorWithSubstr(err, "error discarding run: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error reading run", func(t *testing.T) {
+		r, _ := setup(t)
+		r.WorkingDirectory = dir
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(nil, fmt.Errorf("NO"))
+		if _, err := r.out(input); didntErrorWithSubstr(err, "error retrieving run: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("missing run ID", func(t *testing.T) {
+		r, _ := setup(t)
+		r.WorkingDirectory = dir
+		missing := input
+		missing.Params.Run = "nothing"
+		if _, err := r.out(missing); didntErrorWithSubstr(err, "error reading run ID") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := path.Join(wd, "test_output", "test_apply")
+	_ = os.MkdirAll(path.Join(dir, "plan"), os.FileMode(0755))
+	_ = os.WriteFile(path.Join(dir, "plan", "run_id"), []byte("run-123"), os.FileMode(0644))
+	_ = os.WriteFile(path.Join(dir, "plan", "metadata.json"), []byte(`{"final_status":"planned"}`),
+		os.FileMode(0644))
+
+	input := inputJSON{Params: paramsJSON{
+		Action:       actionApply,
+		Run:          "plan",
+		ApplyMessage: "Approved",
+	}}
+
+	t.Run("applies the run", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.ID = "run-123"
+		run.Status = tfe.RunPlanned
+		applying := run
+		applying.Status = tfe.RunApplyQueued
+		gomock.InOrder(
+			r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil),
+			r.runs.EXPECT().Apply(gomock.Any(), "run-123", tfe.RunApplyOptions{Comment: tfe.String("Approved")}).Return(nil),
+			r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&applying, nil),
+		)
+
+		byteVal, err := r.out(input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var result outOutputJSON
+		_ = json.Unmarshal(byteVal, &result)
+		if result.Version.Ref != "run-123" {
+			t.Errorf("unexpected version %s", result.Version.Ref)
+		}
+	})
+	t.Run("status changed", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Status = tfe.RunDiscarded
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		_, err := r.out(input)
+		if didntErrorWithSubstr(err, "has changed status since it was fetched (was planned, now discarded)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("run from another workspace", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.ID = "run-123"
+		run.Status = tfe.RunPlanned
+		run.Workspace = &tfe.Workspace{ID: "other"}
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		if _, err := r.out(input); didntErrorWithSubstr(err,
+			"error applying run: run run-123 doesn't belong to workspace foo") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("not confirmable", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Status = tfe.RunPlanned
+		run.Actions.IsConfirmable = false
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		if _, err := r.out(input); didntErrorWithSubstr(err, "can't be confirmed (status = planned)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("guardrail failure", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Status = tfe.RunPlanned
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(&tfe.Plan{ID: "plan-1", ResourceDestructions: 1}, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		guarded := input
+		guarded.Params.Guardrails = guardrailsJSON{MaxDestroy: tfe.Int(0)}
+		if _, err := r.out(guarded); didntErrorWithSubstr(err, "guardrails failed") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error applying", func(t *testing.T) {
+		r, run := setup(t)
+		r.WorkingDirectory = dir
+		run.Status = tfe.RunPlanned
+		r.runs.EXPECT().Read(gomock.Any(), "run-123").Return(&run, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("NO"))
+		if _, err := r.out(input); didntErrorWithSubstr(err, "error applying run: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("missing metadata", func(t *testing.T) {
+		r, _ := setup(t)
+		r.WorkingDirectory = dir
+		_ = os.MkdirAll(path.Join(r.WorkingDirectory, "partial"), os.FileMode(0755))
+		_ = os.WriteFile(path.Join(r.WorkingDirectory, "partial", "run_id"), []byte("run-123"), os.FileMode(0644))
+		partial := input
+		partial.Params.Run = "partial"
+		if _, err := r.out(partial); didntErrorWithSubstr(err, "error reading run metadata") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
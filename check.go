@@ -1,48 +1,120 @@
 package concourse_tfe_resource
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	tfe "github.com/hashicorp/go-tfe"
+	"time"
 )
 
-func check(input inputJSON) ([]byte, error) {
+const (
+	checkPageSize = 100
+
+	versionFieldCreatedAt = "created_at"
+	versionFieldSource    = "source"
+	versionFieldCommitSHA = "commit_sha"
+)
+
+func (r *Resource) check(input inputJSON) ([]byte, error) {
 	var (
-		page  int  = 0
-		found bool = false
+		known *tfe.Run
+		found bool
 		list  checkOutputJSON
 	)
 
+	limit := input.Source.InitialVersions
+	if input.Version.Ref != "" {
+		// runs listed after the known run are all newer than it, so paging can stop as soon as one is older
+		run, err := r.Client.Runs.Read(r.Context, input.Version.Ref)
+		if err == nil {
+			known = run
+			limit = 0
+		} else if errors.Is(err, tfe.ErrResourceNotFound) {
+			limit = 1
+		} else {
+			return nil, formatError(err, "retrieving run")
+		}
+	}
+
 	rlo := tfe.RunListOptions{
-		ListOptions: tfe.ListOptions{PageSize: 100},
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: checkPageSize},
+		Include:     input.Source.versionIncludes(),
+	}
+	if limit > 0 && limit < checkPageSize {
+		rlo.PageSize = limit
 	}
 
-	for {
-		rlo.PageNumber = page
-		runs, err := client.Runs.List(context.Background(), workspace.ID, &rlo)
+	// collect runs newest first, and reverse them once paging is done
+	for !found {
+		runs, err := r.Client.Runs.List(r.Context, r.Workspace.ID, &rlo)
 		if err != nil {
 			return nil, formatError(err, "listing runs")
 		}
 
 		for _, v := range runs.Items {
-			list = append([]version{{Ref: v.ID}}, list...)
-			if v.ID == input.Version.Ref {
+			if known != nil && v.CreatedAt.Before(known.CreatedAt) {
+				found = true
+				break
+			}
+			list = append(list, input.Source.runVersion(v))
+			if v.ID == input.Version.Ref || (limit > 0 && len(list) == limit) {
 				found = true
 				break
 			}
 		}
-		if found || len(runs.Items) == 0 {
+		if len(runs.Items) == 0 || (runs.Pagination != nil && runs.Pagination.NextPage == 0) {
 			break
-		} else {
-			page++
 		}
+		rlo.PageNumber++
 	}
 
-	if !found && input.Version.Ref != "" && len(list) > 0 {
+	if len(list) > 0 && input.Version.Ref != "" && list[len(list)-1].Ref != input.Version.Ref {
 		// "if your resource is unable to determine which versions are newer than the given version, then the
 		// current version of your resource should be returned"
-		list = checkOutputJSON{list[len(list)-1]}
+		list = list[:1]
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
 	}
 
 	return json.Marshal(list)
 }
+
+// runVersion returns the run's version, with the fields chosen in version_fields. They all stay the same for the life
+// of the run, so a run is only ever one version.
+func (s sourceJSON) runVersion(run *tfe.Run) version {
+	v := version{Ref: run.ID}
+	for _, field := range s.VersionFields {
+		switch field {
+		case versionFieldCreatedAt:
+			v.CreatedAt = run.CreatedAt.UTC().Format(time.RFC3339)
+		case versionFieldSource:
+			v.Source = string(run.Source)
+		case versionFieldCommitSHA:
+			v.CommitSHA = commitSHA(run)
+		}
+	}
+	return v
+}
+
+// versionIncludes returns what has to be included with runs to fill in their versions
+func (s sourceJSON) versionIncludes() []tfe.RunIncludeOpt {
+	for _, field := range s.VersionFields {
+		if field == versionFieldCommitSHA {
+			return []tfe.RunIncludeOpt{tfe.RunConfigVer, tfe.RunConfigVerIngress}
+		}
+	}
+	return nil
+}
+
+// readVersion reads the run's version, so a put emits the same version that check will find for its run
+func (r *Resource) readVersion(input inputJSON, run *tfe.Run) (version, error) {
+	if includes := input.Source.versionIncludes(); includes != nil {
+		var err error
+		run, err = r.Client.Runs.ReadWithOptions(r.Context, run.ID, &tfe.RunReadOptions{Include: includes})
+		if err != nil {
+			return version{}, formatError(err, "retrieving run")
+		}
+	}
+	return input.Source.runVersion(run), nil
+}
@@ -1,52 +1,63 @@
 package concourse_tfe_resource
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"github.com/hashicorp/go-tfe"
 	"go.uber.org/mock/gomock"
 	"strconv"
 	"testing"
+	"time"
 )
 
+var checkEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// runList returns runs newest first, as the API does, with run "0" the newest
 func runList(start int, len int) (list tfe.RunList) {
 	for i := 0; i < len; i++ {
-		list.Items = append(list.Items, &tfe.Run{ID: strconv.Itoa(i + start)})
+		list.Items = append(list.Items, checkRun(strconv.Itoa(i+start)))
 	}
 	return
 }
 
+func checkRun(id string) *tfe.Run {
+	age, _ := strconv.Atoi(id)
+	return &tfe.Run{ID: id, CreatedAt: checkEpoch.Add(-time.Duration(age) * time.Minute)}
+}
+
 func TestCheckWithNilVersion(t *testing.T) {
-	setup(t)
+	r, _ := setup(t)
 	result := checkOutputJSON{}
 
-	firstCall := runList(0, 5)
-	input := inputJSON{Source: sourceJSON{Workspace: "foo"}}
+	firstCall := runList(0, 3)
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 3}}
 
-	runs.EXPECT().List(gomock.Any(), gomock.Eq(workspace.ID), gomock.Any()).Return(&firstCall, nil)
-	runs.EXPECT().List(gomock.Any(), gomock.Eq(workspace.ID), gomock.Any()).Return(&tfe.RunList{}, nil)
+	rlo := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 3, PageNumber: 1}}
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq(r.Workspace.ID), gomock.Eq(&rlo)).Return(&firstCall, nil)
 
-	output, _ := check(input)
+	output, _ := r.check(input)
 
 	json.Unmarshal([]byte(output), &result)
 
-	if len(result) != 5 {
+	if len(result) != 3 {
 		t.Errorf("check with nil version returned %d elements", len(result))
-	} else if result[0].Ref != "4" {
-		t.Errorf("check with nil version didn't return the first result")
+	} else if result[0].Ref != "2" || result[2].Ref != "0" {
+		t.Errorf("check with nil version didn't return the most recent runs, oldest first: %v", result)
 	}
 }
 
 func TestCheckWithExistingVersion(t *testing.T) {
-	setup(t)
+	r, _ := setup(t)
 	result := checkOutputJSON{}
 
 	firstCall := runList(0, 5)
-	input := inputJSON{Source: sourceJSON{Workspace: "foo"}}
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 1}}
 
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Any()).Return(&firstCall, nil)
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Eq("2")).Return(checkRun("2"), nil)
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Any()).Return(&firstCall, nil)
 	input.Version.Ref = "2"
-	output, _ := check(input)
+	output, _ := r.check(input)
 
 	json.Unmarshal([]byte(output), &result)
 
@@ -58,19 +69,20 @@ func TestCheckWithExistingVersion(t *testing.T) {
 }
 
 func TestCheckWithVersionOnSecondPage(t *testing.T) {
-	setup(t)
+	r, _ := setup(t)
 	result := checkOutputJSON{}
 
 	firstCall := runList(0, 5)
 	secondCall := runList(5, 5)
-	input := inputJSON{Source: sourceJSON{Workspace: "foo"}}
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 1}}
 
-	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 0}}
-	rlo2 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 1}}
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, nil)
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo2)).Return(&secondCall, nil)
+	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 1}}
+	rlo2 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 2}}
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Eq("8")).Return(checkRun("8"), nil)
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, nil)
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo2)).Return(&secondCall, nil)
 	input.Version.Ref = "8"
-	output, _ := check(input)
+	output, _ := r.check(input)
 
 	json.Unmarshal([]byte(output), &result)
 	if len(result) != 9 {
@@ -81,19 +93,18 @@ func TestCheckWithVersionOnSecondPage(t *testing.T) {
 }
 
 func TestCheckWithNonexistentVersion(t *testing.T) {
-	setup(t)
+	r, _ := setup(t)
 	result := checkOutputJSON{}
 
-	firstCall := runList(0, 5)
-	input := inputJSON{Source: sourceJSON{Workspace: "foo"}}
+	firstCall := runList(0, 1)
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 10}}
 
 	// if the provided version does not seem to exist, return the current version
-	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 0}}
-	rlo2 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 1}}
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, nil)
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo2)).Return(&tfe.RunList{}, nil)
+	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 1, PageNumber: 1}}
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Eq("8")).Return(nil, tfe.ErrResourceNotFound)
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, nil)
 	input.Version.Ref = "8"
-	output, _ := check(input)
+	output, _ := r.check(input)
 
 	json.Unmarshal([]byte(output), &result)
 
@@ -104,18 +115,89 @@ func TestCheckWithNonexistentVersion(t *testing.T) {
 	}
 }
 
+func TestCheckWithUnlistedVersion(t *testing.T) {
+	r, _ := setup(t)
+	result := checkOutputJSON{}
+
+	firstCall := runList(0, 5)
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 1}}
+
+	// the run exists but isn't listed, so paging stops at the first older run rather than walking the history
+	unlisted := &tfe.Run{ID: "other", CreatedAt: checkRun("2").CreatedAt.Add(-time.Second)}
+	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 1}}
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Eq("other")).Return(unlisted, nil)
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, nil)
+	input.Version.Ref = "other"
+	output, _ := r.check(input)
+
+	json.Unmarshal([]byte(output), &result)
+
+	if len(result) != 1 || result[0].Ref != "0" {
+		t.Errorf("check with unlisted version returned %v", result)
+	}
+}
+
 func TestCheckWithFailingListCall(t *testing.T) {
-	setup(t)
+	r, _ := setup(t)
 	result := checkOutputJSON{}
 
 	firstCall := runList(0, 5)
-	input := inputJSON{Source: sourceJSON{Workspace: "foo"}}
+	input := inputJSON{Source: sourceJSON{Workspace: "foo", InitialVersions: 100}}
 
-	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 0}}
-	runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, errors.New("NO"))
-	output, err := check(input)
+	rlo1 := tfe.RunListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 1}}
+	r.runs.EXPECT().List(gomock.Any(), gomock.Eq("foo"), gomock.Eq(&rlo1)).Return(&firstCall, errors.New("NO"))
+	output, err := r.check(input)
 
 	if output != nil || err == nil || err.Error() != "error listing runs: NO" {
 		t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 	}
+
+	input.Version.Ref = "2"
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Eq("2")).Return(nil, errors.New("NO"))
+	output, err = r.check(input)
+
+	if output != nil || err == nil || err.Error() != "error retrieving run: NO" {
+		t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", output, err)
+	}
+}
+
+func TestCheckVersionFields(t *testing.T) {
+	fake := newFakeTFE(t)
+	run := fake.addRun("TestCheckVersionFields", tfe.RunApplied)
+	run.Source = tfe.RunSourceUI
+	run.ConfigurationVersion.IngressAttributes = &tfe.IngressAttributes{ID: "ia-" + run.ID, CommitSHA: "0123abc"}
+	source := fake.source()
+	source.VersionFields = []string{versionFieldCreatedAt, versionFieldSource, versionFieldCommitSHA}
+
+	request, _ := json.Marshal(inputJSON{Source: source, Params: paramsJSON{PollingPeriod: 1}})
+	output, err := (&Resource{}).Check(bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("check failed: %s", err)
+	}
+	var result checkOutputJSON
+	_ = json.Unmarshal(output, &result)
+	expected := version{Ref: run.ID, CreatedAt: run.CreatedAt.UTC().Format(time.RFC3339), Source: "tfe-ui",
+		CommitSHA: "0123abc"}
+	if len(result) != 1 || result[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	// a put emits the same version that check finds for its run
+	output, err = (&Resource{WorkingDirectory: t.TempDir()}).Out(bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("out failed: %s", err)
+	}
+	var outResult outOutputJSON
+	_ = json.Unmarshal(output, &outResult)
+	if outResult.Version.CreatedAt == "" {
+		t.Errorf("out didn't emit the version fields: %+v", outResult.Version)
+	}
+	request, _ = json.Marshal(inputJSON{Source: source, Params: paramsJSON{PollingPeriod: 1},
+		Version: outResult.Version})
+	output, _ = (&Resource{}).Check(bytes.NewReader(request))
+	result = nil
+	_ = json.Unmarshal(output, &result)
+	if len(result) != 1 || result[0] != outResult.Version {
+		t.Errorf("check found %+v for put version %+v", result, outResult.Version)
+	}
 }
@@ -2,45 +2,71 @@ package concourse_tfe_resource
 
 import (
 	"concourse-tfe-resource/mock-go-tfe"
+	"context"
 	"github.com/hashicorp/go-tfe"
 	"go.uber.org/mock/gomock"
+	"log"
 	"strings"
 	"testing"
 	"time"
 )
 
-var (
-	ctrl          *gomock.Controller
-	mockClient    tfe.Client
-	runs          *mock_go_tfe.MockRuns
-	workspaces    *mock_go_tfe.MockWorkspaces
-	variables     *mock_go_tfe.MockVariables
-	stateVersions *mock_go_tfe.MockStateVersions
-	test          *testing.T
-)
-
-func setup(t *testing.T) tfe.Run {
-	test = t
-	ctrl = gomock.NewController(t)
+// testResource is a Resource whose API services are all mocks
+type testResource struct {
+	*Resource
+	runs           *mock_go_tfe.MockRuns
+	workspaces     *mock_go_tfe.MockWorkspaces
+	variables      *mock_go_tfe.MockVariables
+	stateVersions  *mock_go_tfe.MockStateVersions
+	configVersions *mock_go_tfe.MockConfigurationVersions
+	policyChecks   *mock_go_tfe.MockPolicyChecks
+	taskStages     *mock_go_tfe.MockTaskStages
+	policyOutcomes *mock_go_tfe.MockPolicySetOutcomes
+	comments       *mock_go_tfe.MockComments
+	costEstimates  *mock_go_tfe.MockCostEstimates
+	plans          *mock_go_tfe.MockPlans
+}
 
-	mockClient = tfe.Client{}
-	client = &mockClient
-	runs = mock_go_tfe.NewMockRuns(ctrl)
-	client.Runs = runs
-	workspaces = mock_go_tfe.NewMockWorkspaces(ctrl)
-	client.Workspaces = workspaces
-	variables = mock_go_tfe.NewMockVariables(ctrl)
-	client.Variables = variables
-	stateVersions = mock_go_tfe.NewMockStateVersions(ctrl)
-	client.StateVersions = stateVersions
+func setup(t *testing.T) (*testResource, tfe.Run) {
+	ctrl := gomock.NewController(t)
+	r := &testResource{
+		runs:           mock_go_tfe.NewMockRuns(ctrl),
+		workspaces:     mock_go_tfe.NewMockWorkspaces(ctrl),
+		variables:      mock_go_tfe.NewMockVariables(ctrl),
+		stateVersions:  mock_go_tfe.NewMockStateVersions(ctrl),
+		configVersions: mock_go_tfe.NewMockConfigurationVersions(ctrl),
+		policyChecks:   mock_go_tfe.NewMockPolicyChecks(ctrl),
+		taskStages:     mock_go_tfe.NewMockTaskStages(ctrl),
+		policyOutcomes: mock_go_tfe.NewMockPolicySetOutcomes(ctrl),
+		comments:       mock_go_tfe.NewMockComments(ctrl),
+		costEstimates:  mock_go_tfe.NewMockCostEstimates(ctrl),
+		plans:          mock_go_tfe.NewMockPlans(ctrl),
+	}
+	r.Resource = &Resource{
+		Client: Client{
+			Runs:                  r.runs,
+			Workspaces:            r.workspaces,
+			Variables:             r.variables,
+			StateVersions:         r.stateVersions,
+			ConfigurationVersions: r.configVersions,
+			PolicyChecks:          r.policyChecks,
+			TaskStages:            r.taskStages,
+			PolicySetOutcomes:     r.policyOutcomes,
+			Comments:              r.comments,
+			CostEstimates:         r.costEstimates,
+			Plans:                 r.plans,
+		},
+		Context: context.Background(),
+		Logger:  log.Default(),
+	}
 
-	workspace = &tfe.Workspace{
+	r.Workspace = &tfe.Workspace{
 		ID:           "foo",
 		Organization: &tfe.Organization{CostEstimationEnabled: false},
 	}
 
-	return tfe.Run{
-		ID:        "bar",
+	return r, tfe.Run{
+		ID:        "run-bar",
 		Status:    tfe.RunPending,
 		Message:   "test run",
 		CreatedAt: time.Now(),
@@ -49,6 +75,7 @@ func setup(t *testing.T) tfe.Run {
 			ProposedMonthlyCost: "a few cents",
 		},
 		Actions:              &tfe.RunActions{IsConfirmable: true},
+		Workspace:            &tfe.Workspace{ID: "foo"},
 		ConfigurationVersion: &tfe.ConfigurationVersion{Source: tfe.ConfigurationSourceGithub},
 		HasChanges:           true,
 	}
@@ -0,0 +1,75 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"strconv"
+)
+
+type costEstimateJSON struct {
+	Status string `json:"status"`
+	// costs are null when the estimate didn't produce them
+	PriorMonthlyCost        *float64 `json:"prior_monthly_cost"`
+	ProposedMonthlyCost     *float64 `json:"proposed_monthly_cost"`
+	DeltaMonthlyCost        *float64 `json:"delta_monthly_cost"`
+	ResourcesCount          int      `json:"resources_count"`
+	MatchedResourcesCount   int      `json:"matched_resources_count"`
+	UnmatchedResourcesCount int      `json:"unmatched_resources_count"`
+	ErrorMessage            string   `json:"error_message,omitempty"`
+}
+
+// getCostEstimate reads the run's cost estimate, since reading a run only includes its ID
+func (r *Resource) getCostEstimate(run *tfe.Run) (*tfe.CostEstimate, error) {
+	if run.CostEstimate == nil || run.CostEstimate.ID == "" {
+		return run.CostEstimate, nil
+	}
+	ce, err := r.Client.CostEstimates.Read(r.Context, run.CostEstimate.ID)
+	if err != nil {
+		return nil, formatError(err, "reading cost estimate")
+	}
+	return ce, nil
+}
+
+func costEstimateOutput(ce *tfe.CostEstimate) costEstimateJSON {
+	return costEstimateJSON{
+		Status:                  string(ce.Status),
+		PriorMonthlyCost:        parseCost(ce.PriorMonthlyCost),
+		ProposedMonthlyCost:     parseCost(ce.ProposedMonthlyCost),
+		DeltaMonthlyCost:        parseCost(ce.DeltaMonthlyCost),
+		ResourcesCount:          ce.ResourcesCount,
+		MatchedResourcesCount:   ce.MatchedResourcesCount,
+		UnmatchedResourcesCount: ce.UnmatchedResourcesCount,
+		ErrorMessage:            ce.ErrorMessage,
+	}
+}
+
+func parseCost(cost string) *float64 {
+	value, err := strconv.ParseFloat(cost, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// checkCostDelta refuses to confirm a run whose estimated monthly cost delta exceeds max_monthly_cost_delta
+func (r *Resource) checkCostDelta(input inputJSON, run *tfe.Run) error {
+	if input.Params.MaxMonthlyCostDelta == nil {
+		return nil
+	}
+	ce, err := r.getCostEstimate(run)
+	if err != nil {
+		return err
+	}
+	if ce == nil || ce.Status != tfe.CostEstimateFinished {
+		return fmt.Errorf("error confirming run: max_monthly_cost_delta is set but no cost estimate is available")
+	}
+	delta := parseCost(ce.DeltaMonthlyCost)
+	if delta == nil {
+		return fmt.Errorf("error confirming run: can't read cost estimate delta \"%s\"", ce.DeltaMonthlyCost)
+	}
+	if *delta > *input.Params.MaxMonthlyCostDelta {
+		return fmt.Errorf("error confirming run: estimated monthly cost delta of %s exceeds max_monthly_cost_delta "+
+			"of %v", ce.DeltaMonthlyCost, *input.Params.MaxMonthlyCostDelta)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func TestCostEstimateOutput(t *testing.T) {
+	output := costEstimateOutput(&tfe.CostEstimate{
+		Status:                  tfe.CostEstimateFinished,
+		PriorMonthlyCost:        "10.00",
+		ProposedMonthlyCost:     "25.50",
+		DeltaMonthlyCost:        "+15.50",
+		ResourcesCount:          4,
+		MatchedResourcesCount:   3,
+		UnmatchedResourcesCount: 1,
+	})
+	result, _ := json.Marshal(output)
+	expected := `{"status":"finished","prior_monthly_cost":10,"proposed_monthly_cost":25.5,"delta_monthly_cost":15.5,` +
+		`"resources_count":4,"matched_resources_count":3,"unmatched_resources_count":1}`
+	if string(result) != expected {
+		t.Errorf("unexpected cost estimate output: %s", result)
+	}
+
+	output = costEstimateOutput(&tfe.CostEstimate{Status: tfe.CostEstimateErrored, ErrorMessage: "boom"})
+	if output.DeltaMonthlyCost != nil || output.ErrorMessage != "boom" {
+		t.Errorf("unexpected output for errored estimate: %v", output)
+	}
+}
+
+func TestCheckCostDelta(t *testing.T) {
+	limit := 10.0
+	input := inputJSON{Params: paramsJSON{MaxMonthlyCostDelta: &limit}}
+
+	t.Run("no threshold", func(t *testing.T) {
+		r, run := setup(t)
+		if err := r.checkCostDelta(inputJSON{}, &run); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("under threshold", func(t *testing.T) {
+		r, run := setup(t)
+		run.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+		r.costEstimates.EXPECT().Read(gomock.Any(), "ce-1").Return(
+			&tfe.CostEstimate{Status: tfe.CostEstimateFinished, DeltaMonthlyCost: "-5.00"}, nil)
+		if err := r.checkCostDelta(input, &run); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("over threshold", func(t *testing.T) {
+		r, run := setup(t)
+		run.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+		r.costEstimates.EXPECT().Read(gomock.Any(), "ce-1").Return(
+			&tfe.CostEstimate{Status: tfe.CostEstimateFinished, DeltaMonthlyCost: "+10.01"}, nil)
+		err := r.checkCostDelta(input, &run)
+		if didntErrorWithSubstr(err, "estimated monthly cost delta of +10.01 exceeds max_monthly_cost_delta of 10") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("no estimate", func(t *testing.T) {
+		r, run := setup(t)
+		run.CostEstimate = nil
+		if err := r.checkCostDelta(input, &run); didntErrorWithSubstr(err, "no cost estimate is available") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("unreadable delta", func(t *testing.T) {
+		r, run := setup(t)
+		run.CostEstimate.Status = tfe.CostEstimateFinished
+		if err := r.checkCostDelta(input, &run); didntErrorWithSubstr(err, "can't read cost estimate delta") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error reading estimate", func(t *testing.T) {
+		r, run := setup(t)
+		run.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+		r.costEstimates.EXPECT().Read(gomock.Any(), "ce-1").Return(nil, fmt.Errorf("NO"))
+		if err := r.checkCostDelta(input, &run); didntErrorWithSubstr(err, "error reading cost estimate: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package concourse_tfe_resource
+
+import (
+	"errors"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"strings"
+)
+
+type (
+	// APIError is an error from the Terraform Cloud API, with a hint about what usually causes it
+	APIError struct {
+		Kind APIErrorKind
+		// what the resource was doing, like "getting workspace"
+		Action string
+		// the workspace permission Action needs, as listed in the README
+		Permission string
+		Hint       string
+		Err        error
+	}
+	APIErrorKind string
+)
+
+const (
+	APIErrorNotFound     APIErrorKind = "not found"
+	APIErrorUnauthorized APIErrorKind = "unauthorized"
+	APIErrorForbidden    APIErrorKind = "forbidden"
+	APIErrorInvalid      APIErrorKind = "invalid"
+	APIErrorLocked       APIErrorKind = "locked"
+
+	permissionReadRuns        = "read runs"
+	permissionQueuePlans      = "queue plans"
+	permissionApplyRuns       = "apply runs"
+	permissionReadVariables   = "read variables"
+	permissionWriteVariables  = "read and write variables"
+	permissionReadOutputs     = "read state outputs"
+	permissionReadState       = "read state versions"
+	permissionPolicyOverrides = "manage policy overrides"
+)
+
+// apiActions maps the start of each action which calls the Terraform Cloud API to the permission it needs. Errors
+// from anything else, like exchanging a workload identity token, are only classified by go-tfe's own errors.
+var apiActions = []struct {
+	action     string
+	permission string
+}{
+	{"getting workspace", permissionReadRuns},
+	{"listing runs", permissionReadRuns},
+	{"listing pending runs", permissionReadRuns},
+	{"retrieving run", permissionReadRuns},
+	{"listing policy", permissionReadRuns},
+	{"listing task stages", permissionReadRuns},
+	{"reading task stage", permissionReadRuns},
+	{"reading cost estimate", permissionReadRuns},
+	{"reading plan", permissionReadRuns},
+	{"reading JSON plan", permissionReadRuns},
+	{"retrieving plan logs", permissionReadRuns},
+	{"getting configuration version", permissionReadRuns},
+	{"downloading configuration version", permissionReadRuns},
+	{"commenting on run", permissionReadRuns},
+	{"creating run", permissionQueuePlans},
+	{"applying run", permissionApplyRuns},
+	{"discarding run", permissionApplyRuns},
+	{"canceling run", permissionApplyRuns},
+	{"overriding", permissionPolicyOverrides},
+	{"creating variable", permissionWriteVariables},
+	{"updating variable", permissionWriteVariables},
+	{"retrieving workspace variables", permissionReadVariables},
+	{"getting current workspace state", permissionReadOutputs},
+	{"downloading workspace state", permissionReadState},
+	{"listing workspace state versions", permissionReadState},
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("error %s: %s (%s)", e.Action, e.Err, e.Hint)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError returns an APIError if err is one of the API failures users commonly misread, or nil otherwise.
+// go-tfe only has sentinel errors for some responses, so the others are recognised by their message, but only when
+// they come from an API call.
+func classifyError(err error, action string) *APIError {
+	apiErr := &APIError{Action: action, Permission: permissionReadRuns, Err: err}
+	api := false
+	for _, required := range apiActions {
+		if strings.HasPrefix(action, required.action) {
+			apiErr.Permission = required.permission
+			api = true
+			break
+		}
+	}
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, tfe.ErrUnauthorized):
+		apiErr.Kind = APIErrorUnauthorized
+		apiErr.Hint = "the token is invalid or has expired; check the token source in the source configuration"
+	case errors.Is(err, tfe.ErrResourceNotFound) && action == "getting workspace":
+		apiErr.Kind = APIErrorNotFound
+		apiErr.Hint = "check the organization and workspace names, and that the token has at least " +
+			permissionReadRuns + " permission on the workspace; Terraform Cloud reports workspaces the token can't " +
+			"see as not found"
+	case errors.Is(err, tfe.ErrResourceNotFound):
+		apiErr.Kind = APIErrorNotFound
+		apiErr.Hint = fmt.Sprintf("Terraform Cloud also reports this when the token doesn't have %s permission on "+
+			"the workspace", apiErr.Permission)
+	case api && strings.Contains(message, "forbidden"):
+		apiErr.Kind = APIErrorForbidden
+		apiErr.Hint = fmt.Sprintf("the token needs %s permission on the workspace", apiErr.Permission)
+	case errors.Is(err, tfe.ErrWorkspaceLocked) || (api && strings.Contains(message, "is locked")):
+		apiErr.Kind = APIErrorLocked
+		apiErr.Hint = "the workspace is locked; unlock it in Terraform Cloud, or wait for whoever locked it to finish"
+	// go-tfe validates some options itself, with errors like "invalid value for run ID", which never reach the API
+	case api && strings.HasPrefix(message, "invalid attribute"):
+		apiErr.Kind = APIErrorInvalid
+		apiErr.Hint = "Terraform Cloud rejected the request; check the source configuration, params and version"
+	default:
+		return nil
+	}
+	return apiErr
+}
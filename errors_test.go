@@ -0,0 +1,94 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestFormatError(t *testing.T) {
+	tests := []struct {
+		err        error
+		action     string
+		kind       APIErrorKind
+		permission string
+		message    string
+	}{
+		{tfe.ErrResourceNotFound, "getting workspace", APIErrorNotFound, permissionReadRuns,
+			"error getting workspace: resource not found (check the organization and workspace names"},
+		{tfe.ErrResourceNotFound, "applying run", APIErrorNotFound, permissionApplyRuns,
+			"error applying run: resource not found (Terraform Cloud also reports this when the token doesn't have " +
+				"apply runs permission on the workspace)"},
+		{fmt.Errorf("wrapped: %w", tfe.ErrUnauthorized), "listing runs", APIErrorUnauthorized, permissionReadRuns,
+			"error listing runs: wrapped: unauthorized (the token is invalid or has expired"},
+		{errors.New("forbidden"), "creating variable \"foo\"", APIErrorForbidden, permissionWriteVariables,
+			"(the token needs read and write variables permission on the workspace)"},
+		{errors.New("conflict\n\nWorkspace is locked"), "creating run", APIErrorLocked, permissionQueuePlans,
+			"(the workspace is locked; unlock it"},
+		{errors.New("invalid attribute\n\nKey has already been taken"), "creating variable \"foo\"", APIErrorInvalid,
+			permissionWriteVariables, "Key has already been taken (Terraform Cloud rejected the request"},
+	}
+	for _, test := range tests {
+		err := formatError(test.err, test.action)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%s while %s wasn't classified", test.err, test.action)
+			continue
+		}
+		if apiErr.Kind != test.kind || apiErr.Permission != test.permission {
+			t.Errorf("%s while %s classified as %s needing %s", test.err, test.action, apiErr.Kind,
+				apiErr.Permission)
+		}
+		if didntErrorWithSubstr(err, test.message) {
+			t.Errorf("expected %q in %q", test.message, err)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s doesn't wrap %s", err, test.err)
+		}
+	}
+
+	for _, test := range []struct {
+		err    error
+		action string
+	}{
+		{os.ErrNotExist, "reading run ID"},
+		{errors.New("exchanging token: 403 Forbidden"), "getting api token"},
+		{tfe.ErrInvalidRunID, "retrieving run"},
+	} {
+		err := formatError(test.err, test.action)
+		if errors.As(err, new(*APIError)) || err.Error() != fmt.Sprintf("error %s: %s", test.action, test.err) {
+			t.Errorf("unexpected error for a non-API error: %s", err)
+		}
+	}
+
+	// an error that has already been explained isn't explained again
+	err := formatError(formatError(tfe.ErrResourceNotFound, "retrieving run"), "waiting for run")
+	if err.Error() != "error waiting for run: error retrieving run: resource not found (Terraform Cloud also "+
+		"reports this when the token doesn't have read runs permission on the workspace)" {
+		t.Errorf("unexpected error for a wrapped API error: %s", err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	fake := newFakeTFE(t)
+	source := fake.source()
+	source.Workspace = "missing"
+	request, _ := json.Marshal(inputJSON{Source: source, Params: paramsJSON{PollingPeriod: 1}})
+	_, err := (&Resource{}).Check(bytes.NewReader(request))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != APIErrorNotFound || apiErr.Action != "getting workspace" {
+		t.Errorf("expected not found error getting workspace, got %s", err)
+	}
+
+	fake.failures["POST runs"] = []int{http.StatusForbidden}
+	request, _ = json.Marshal(inputJSON{Source: fake.source(), Params: paramsJSON{PollingPeriod: 1}})
+	_, err = (&Resource{WorkingDirectory: t.TempDir()}).Out(bytes.NewReader(request))
+	if !errors.As(err, &apiErr) || apiErr.Kind != APIErrorForbidden || apiErr.Permission != permissionQueuePlans {
+		t.Errorf("expected forbidden error needing queue plans, got %s", err)
+	}
+}
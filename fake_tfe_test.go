@@ -0,0 +1,485 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"github.com/hashicorp/jsonapi"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeToken        = "fake-token"
+	fakeOrganization = "fake-org"
+	fakeWorkspace    = "fake-workspace"
+)
+
+type (
+	// fakeTFE is an in-process Terraform Cloud API, detailed enough for go-tfe and the resource. Runs move one status
+	// along their script each time they're read, and wait at the end of it until something acts on them.
+	fakeTFE struct {
+		*httptest.Server
+		mu        sync.Mutex
+		workspace *tfe.Workspace
+		// newest first, like the real API
+		runs      []*fakeRun
+		variables []*tfe.Variable
+		// the workspace has no current state version if outputs is nil
+		outputs   []*tfe.StateVersionOutput
+		stateFile []byte
+		lastID    int
+		// the statuses a queued run moves through before waiting for confirmation, and after it's confirmed
+		planScript  []tfe.RunStatus
+		applyScript []tfe.RunStatus
+		// the next requests for a route (like "GET runs") fail with these statuses, telling the client to retry at once
+		failures map[string][]int
+		// if set, runs queued through the API have a sentinel policy check which soft fails after planning
+		softFailPolicies bool
+	}
+	// the attributes of the run and variable requests handled by the fake
+	fakeAttributes struct {
+		Message     string           `json:"message"`
+		Key         string           `json:"key"`
+		Value       *string          `json:"value"`
+		Description *string          `json:"description"`
+		Category    tfe.CategoryType `json:"category"`
+		HCL         *bool            `json:"hcl"`
+		Sensitive   *bool            `json:"sensitive"`
+	}
+	fakeRun struct {
+		run          *tfe.Run
+		script       []tfe.RunStatus
+		policyChecks []*tfe.PolicyCheck
+		planLog      string
+	}
+)
+
+func newFakeTFE(t *testing.T) *fakeTFE {
+	f := &fakeTFE{
+		workspace: &tfe.Workspace{
+			ID:           "ws-fake",
+			Name:         fakeWorkspace,
+			Organization: &tfe.Organization{Name: fakeOrganization},
+		},
+		outputs:     []*tfe.StateVersionOutput{},
+		failures:    make(map[string][]int),
+		planScript:  []tfe.RunStatus{tfe.RunPlanning, tfe.RunPlanned},
+		applyScript: []tfe.RunStatus{tfe.RunApplying, tfe.RunApplied},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTFE) source() sourceJSON {
+	return sourceJSON{
+		Address:      f.URL,
+		Token:        fakeToken,
+		Organization: fakeOrganization,
+		Workspace:    fakeWorkspace,
+		Retry:        retryJSON{MaxAttempts: 3, MinBackoff: 0.001, MaxBackoff: 1, GracePeriod: 5},
+		// test configs are marshalled from sourceJSON, so getInputs' defaults don't apply
+		InitialVersions: 1,
+	}
+}
+
+// currentStateVersion is written by the most recent applied run
+func (f *fakeTFE) currentStateVersion() *tfe.StateVersion {
+	sv := &tfe.StateVersion{ID: "sv-fake", Outputs: f.outputs, DownloadURL: f.URL + "/state-file"}
+	for _, fr := range f.runs {
+		if fr.run.Status == tfe.RunApplied {
+			sv.Run = &tfe.Run{ID: fr.run.ID}
+			sv.CreatedAt = fr.run.CreatedAt
+			break
+		}
+	}
+	return sv
+}
+
+func (f *fakeTFE) nextID(prefix string) string {
+	f.lastID++
+	return fmt.Sprintf("%s-%d", prefix, f.lastID)
+}
+
+// addRun queues a run which moves through the given statuses as it's read
+func (f *fakeTFE) addRun(message string, script ...tfe.RunStatus) *tfe.Run {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queueRun(message, script)
+}
+
+func (f *fakeTFE) queueRun(message string, script []tfe.RunStatus) *tfe.Run {
+	id := f.nextID("run")
+	fr := &fakeRun{
+		run: &tfe.Run{
+			ID:                   id,
+			Message:              message,
+			Status:               tfe.RunPending,
+			HasChanges:           true,
+			CreatedAt:            time.Now(),
+			Actions:              &tfe.RunActions{},
+			Workspace:            f.workspace,
+			ConfigurationVersion: &tfe.ConfigurationVersion{ID: "cv-" + id, Source: tfe.ConfigurationSourceAPI},
+			Plan:                 &tfe.Plan{ID: "plan-" + id},
+		},
+		script:  append([]tfe.RunStatus{}, script...),
+		planLog: "Plan: 1 to add, 0 to change, 0 to destroy.",
+	}
+	if f.softFailPolicies {
+		fr.policyChecks = []*tfe.PolicyCheck{{
+			ID:      "polchk-" + id,
+			Status:  tfe.PolicySoftFailed,
+			Scope:   tfe.PolicyScopeOrganization,
+			Actions: &tfe.PolicyActions{IsOverridable: true},
+		}}
+		fr.run.PolicyChecks = fr.policyChecks
+	}
+	f.runs = append([]*fakeRun{fr}, f.runs...)
+	fr.updateActions()
+	return fr.run
+}
+
+// advance moves the run to the next status in its script
+func (fr *fakeRun) advance() {
+	if len(fr.script) > 0 {
+		fr.run.Status = fr.script[0]
+		fr.script = fr.script[1:]
+	}
+	fr.updateActions()
+}
+
+func (fr *fakeRun) waiting() bool {
+	return len(fr.script) == 0
+}
+
+func (fr *fakeRun) updateActions() {
+	status := fr.run.Status
+	gate := fr.waiting() && (status == tfe.RunPlanned || status == tfe.RunPolicyChecked || status == tfe.RunCostEstimated)
+	fr.run.Actions = &tfe.RunActions{
+		IsConfirmable: gate && fr.run.HasChanges,
+		IsDiscardable: gate || status == tfe.RunPending || policiesSoftFailed(fr.run),
+		IsCancelable:  status == tfe.RunPlanning || status == tfe.RunApplying,
+	}
+}
+
+func (f *fakeTFE) findRun(id string) *fakeRun {
+	for _, fr := range f.runs {
+		if fr.run.ID == id {
+			return fr
+		}
+	}
+	return nil
+}
+
+func (f *fakeTFE) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2"), "/"), "/")
+	route := req.Method + " " + p[0]
+	if len(p) > 2 {
+		route += " " + p[2]
+	}
+	if len(p) > 4 {
+		route += " " + p[4]
+	}
+
+	if failures := f.failures[route]; len(failures) > 0 {
+		w.Header().Set(headerRetryAfter, "0")
+		writeFakeError(w, failures[0])
+		f.failures[route] = failures[1:]
+		return
+	}
+	if p[0] == "ping" {
+		w.Header().Set("TFP-API-Version", "2.6")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// log URLs are pre-signed, so they're read without the token
+	if req.Header.Get("Authorization") != "Bearer "+fakeToken && p[0] != "plan-logs" {
+		writeFakeError(w, http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		result interface{}
+		status = http.StatusOK
+		err    error
+	)
+	switch route {
+	case "GET organizations workspaces":
+		if p[1] != fakeOrganization || p[3] != fakeWorkspace {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		result = f.workspace
+	case "GET workspaces runs":
+		var runs []*tfe.Run
+		for _, fr := range f.runs {
+			runs = append(runs, fr.run)
+		}
+		f.writeList(w, req, runs)
+		return
+	case "POST runs":
+		var attributes fakeAttributes
+		if attributes, err = readFakeAttributes(req); err == nil {
+			script := f.planScript
+			if f.softFailPolicies {
+				script = append(append([]tfe.RunStatus{}, script...), tfe.RunPolicyChecking, tfe.RunPolicySoftFailed)
+			}
+			result = f.queueRun(attributes.Message, script)
+			status = http.StatusCreated
+		}
+	case "GET runs":
+		fr := f.findRun(p[1])
+		if fr == nil {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		fr.advance()
+		result = fr.run
+	case "POST runs actions":
+		fr := f.findRun(p[1])
+		if fr == nil || !f.act(fr, p[3]) {
+			writeFakeError(w, http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case "POST runs comments":
+		result = &tfe.Comment{ID: f.nextID("wsc")}
+		status = http.StatusCreated
+	case "GET runs policy-checks":
+		fr := f.findRun(p[1])
+		if fr == nil {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		f.writeList(w, req, fr.policyChecks)
+		return
+	case "POST policy-checks actions":
+		for _, fr := range f.runs {
+			for _, check := range fr.policyChecks {
+				if check.ID == p[1] && check.Actions.IsOverridable {
+					check.Status = tfe.PolicyOverridden
+					check.Actions.IsOverridable = false
+					fr.script = []tfe.RunStatus{tfe.RunPolicyChecked}
+					result = check
+				}
+			}
+		}
+		if result == nil {
+			writeFakeError(w, http.StatusConflict)
+			return
+		}
+	case "GET configuration-versions":
+		result = &tfe.ConfigurationVersion{ID: p[1], Source: tfe.ConfigurationSourceAPI,
+			Status: tfe.ConfigurationUploaded}
+	case "GET plans":
+		fr := f.findRun(strings.TrimPrefix(p[1], "plan-"))
+		if fr == nil {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		plan := &tfe.Plan{
+			ID:                p[1],
+			Status:            tfe.PlanFinished,
+			HasChanges:        fr.run.HasChanges,
+			ResourceAdditions: 1,
+			LogReadURL:        f.URL + "/plan-logs/" + fr.run.ID,
+		}
+		if fr.run.Status == tfe.RunPending || fr.run.Status == tfe.RunPlanning {
+			plan.Status = tfe.PlanRunning
+		}
+		result = plan
+	case "GET plans json-output":
+		_, _ = w.Write([]byte(`{"resource_changes":[]}`))
+		return
+	case "GET plan-logs":
+		fr := f.findRun(p[1])
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		if fr == nil || offset > len(fr.planLog) {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		end := offset + limit
+		if end > len(fr.planLog) {
+			end = len(fr.planLog)
+		}
+		_, _ = w.Write([]byte(fr.planLog[offset:end]))
+		return
+	case "GET workspaces vars":
+		f.writeList(w, req, f.variables)
+		return
+	case "POST workspaces vars":
+		var attributes fakeAttributes
+		if attributes, err = readFakeAttributes(req); err == nil {
+			v := &tfe.Variable{ID: f.nextID("var"), Key: attributes.Key, Category: attributes.Category}
+			attributes.update(v)
+			f.variables = append(f.variables, v)
+			result = v
+			status = http.StatusCreated
+		}
+	case "PATCH workspaces vars":
+		var attributes fakeAttributes
+		if attributes, err = readFakeAttributes(req); err == nil {
+			for _, v := range f.variables {
+				if v.ID == p[3] {
+					attributes.update(v)
+					result = v
+				}
+			}
+		}
+	case "GET workspaces current-state-version":
+		if f.outputs == nil {
+			writeFakeError(w, http.StatusNotFound)
+			return
+		}
+		result = f.currentStateVersion()
+	case "GET state-versions":
+		var versions []*tfe.StateVersion
+		if f.outputs != nil {
+			versions = append(versions, f.currentStateVersion())
+		}
+		f.writeList(w, req, versions)
+		return
+	case "GET state-file":
+		_, _ = w.Write(f.stateFile)
+		return
+	default:
+		writeFakeError(w, http.StatusNotFound)
+		return
+	}
+
+	if err != nil || result == nil {
+		writeFakeError(w, http.StatusUnprocessableEntity)
+		return
+	}
+	payload, err := jsonapi.Marshal(result)
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError)
+		return
+	}
+	one := payload.(*jsonapi.OnePayload)
+	nestAttributes(append(one.Included, one.Data))
+	w.Header().Set("Content-Type", jsonapi.MediaType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(one)
+}
+
+// act applies a run action, returning false if the run isn't in a state which allows it
+func (f *fakeTFE) act(fr *fakeRun, action string) bool {
+	switch {
+	case action == "apply" && fr.run.Actions.IsConfirmable:
+		fr.run.Status = tfe.RunConfirmed
+		fr.script = append([]tfe.RunStatus{}, f.applyScript...)
+	case action == "discard" && fr.run.Actions.IsDiscardable:
+		fr.run.Status = tfe.RunDiscarded
+		fr.script = nil
+	case action == "cancel" && fr.run.Actions.IsCancelable:
+		fr.run.Status = tfe.RunCanceled
+		fr.script = nil
+	default:
+		return false
+	}
+	fr.updateActions()
+	return true
+}
+
+// writeList writes one page of items, honouring the page[number] and page[size] parameters
+func (f *fakeTFE) writeList(w http.ResponseWriter, req *http.Request, items interface{}) {
+	payload, err := jsonapi.Marshal(items)
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError)
+		return
+	}
+	many := payload.(*jsonapi.ManyPayload)
+	nestAttributes(append(many.Included, many.Data...))
+	page, _ := strconv.Atoi(req.URL.Query().Get("page[number]"))
+	size, _ := strconv.Atoi(req.URL.Query().Get("page[size]"))
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 {
+		size = 20
+	}
+	total := len(many.Data)
+	start, end := (page-1)*size, page*size
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	many.Data = many.Data[start:end]
+	pagination := map[string]interface{}{"current-page": page, "total-count": total}
+	if end < total {
+		pagination["next-page"] = page + 1
+	}
+	many.Meta = &jsonapi.Meta{"pagination": pagination}
+
+	w.Header().Set("Content-Type", jsonapi.MediaType)
+	_ = json.NewEncoder(w).Encode(many)
+}
+
+// nestAttributes rewrites struct attributes like run actions using their jsonapi names. jsonapi marshals them with
+// the Go field names, but go-tfe unmarshals them by their jsonapi tags.
+func nestAttributes(nodes []*jsonapi.Node) {
+	for _, node := range nodes {
+		for name, attribute := range node.Attributes {
+			value := reflect.ValueOf(attribute)
+			if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+				continue
+			}
+			nested := make(map[string]interface{})
+			for i := 0; i < value.Elem().NumField(); i++ {
+				tag := strings.Split(value.Elem().Type().Field(i).Tag.Get("jsonapi"), ",")
+				if len(tag) > 1 && tag[0] == "attr" {
+					nested[tag[1]] = value.Elem().Field(i).Interface()
+				}
+			}
+			node.Attributes[name] = nested
+		}
+	}
+}
+
+// readFakeAttributes reads the attributes of a create or update request. jsonapi can't unmarshal into go-tfe's
+// option structs, since they use pointers to named string types.
+func readFakeAttributes(req *http.Request) (fakeAttributes, error) {
+	var body struct {
+		Data struct {
+			Attributes fakeAttributes `json:"attributes"`
+		} `json:"data"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	return body.Data.Attributes, err
+}
+
+func (a fakeAttributes) update(v *tfe.Variable) {
+	if a.Value != nil {
+		v.Value = *a.Value
+	}
+	if a.Description != nil {
+		v.Description = *a.Description
+	}
+	if a.HCL != nil {
+		v.HCL = *a.HCL
+	}
+	if a.Sensitive != nil {
+		v.Sensitive = *a.Sensitive
+	}
+}
+
+func writeFakeError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", jsonapi.MediaType)
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"errors":[{"status":"%d","title":"%s"}]}`, status, http.StatusText(status))
+}
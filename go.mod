@@ -4,8 +4,13 @@ go 1.19
 
 require (
 	github.com/drone/envsubst v1.0.3
+	github.com/hashicorp/go-slug v0.15.2
 	github.com/hashicorp/go-tfe v1.64.2
+	github.com/hashicorp/hcl/v2 v2.19.1
+	github.com/hashicorp/jsonapi v1.3.1
+	github.com/zclconf/go-cty v1.14.4
 	go.uber.org/mock v0.4.0
+	sigs.k8s.io/yaml v1.4.0
 )
 
 require (
@@ -14,11 +19,13 @@ require (
 )
 
 require (
+	github.com/agext/levenshtein v1.2.1 // indirect
+	github.com/apparentlymart/go-textseg/v15 v15.0.0 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
-	github.com/hashicorp/go-slug v0.15.2 // indirect
-	github.com/hashicorp/jsonapi v1.3.1 // indirect
+	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
 	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/time v0.6.0 // indirect
 )
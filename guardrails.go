@@ -0,0 +1,132 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"strings"
+)
+
+type (
+	guardrailsJSON struct {
+		MaxDestroy         *int     `json:"max_destroy"`
+		MaxChanges         *int     `json:"max_changes"`
+		ForbidDestroyTypes []string `json:"forbid_destroy_types"`
+		ForbidReplace      bool     `json:"forbid_replace"`
+		Discard            bool     `json:"discard"`
+	}
+	// the parts of terraform's JSON plan representation needed to find destroyed and replaced resources
+	jsonPlan struct {
+		ResourceChanges []jsonResourceChange `json:"resource_changes"`
+	}
+	jsonResourceChange struct {
+		Address string `json:"address"`
+		Type    string `json:"type"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	}
+)
+
+// changes is true if the resource is created, updated or deleted; a replacement is one change
+func (rc jsonResourceChange) changes() bool {
+	for _, action := range rc.Change.Actions {
+		if action == "create" || action == "update" || action == "delete" {
+			return true
+		}
+	}
+	return false
+}
+
+// needsJSONPlan is true for the guardrails which look at each resource. The plan's counts can't be used for
+// max_changes, since they count a replaced resource as both an addition and a destruction.
+func (g guardrailsJSON) needsJSONPlan() bool {
+	return len(g.ForbidDestroyTypes) > 0 || g.ForbidReplace || g.MaxChanges != nil
+}
+
+func (g guardrailsJSON) empty() bool {
+	return g.MaxDestroy == nil && !g.needsJSONPlan()
+}
+
+// checkGuardrails is called before confirming a run, and fails if the plan does anything the guardrails forbid. The
+// run is discarded if guardrails.discard is set, otherwise it is left waiting for confirmation.
+func (r *Resource) checkGuardrails(input inputJSON, run *tfe.Run) error {
+	guardrails := input.Params.Guardrails
+	if guardrails.empty() {
+		return nil
+	}
+	violations, err := r.guardrailViolations(guardrails, run)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	report := "error confirming run: guardrails failed:\n  - " + strings.Join(violations, "\n  - ")
+	if guardrails.Discard {
+		comment := "Discarded because guardrails failed: " + strings.Join(violations, "; ")
+		err := r.Client.Runs.Discard(r.Context, run.ID, tfe.RunDiscardOptions{Comment: &comment})
+		if err != nil {
+			return formatError(err, "discarding run")
+		}
+		r.Logger.Print("Run discarded")
+	}
+	return errors.New(report)
+}
+
+func (r *Resource) guardrailViolations(guardrails guardrailsJSON, run *tfe.Run) ([]string, error) {
+	var violations []string
+	if run.Plan == nil {
+		return nil, fmt.Errorf("error checking guardrails: run has no plan")
+	}
+	plan, err := r.Client.Plans.Read(r.Context, run.Plan.ID)
+	if err != nil {
+		return nil, formatError(err, "reading plan")
+	}
+
+	if guardrails.MaxDestroy != nil && plan.ResourceDestructions > *guardrails.MaxDestroy {
+		violations = append(violations, fmt.Sprintf("plan destroys %d resources (max_destroy is %d)",
+			plan.ResourceDestructions, *guardrails.MaxDestroy))
+	}
+	if !guardrails.needsJSONPlan() {
+		return violations, nil
+	}
+
+	var jp jsonPlan
+	byteVal, err := r.Client.Plans.ReadJSONOutput(r.Context, plan.ID)
+	if err != nil {
+		return nil, formatError(err, "reading JSON plan")
+	}
+	if err := json.Unmarshal(byteVal, &jp); err != nil {
+		return nil, formatError(err, "parsing JSON plan")
+	}
+	if guardrails.MaxChanges != nil {
+		changes := 0
+		for _, rc := range jp.ResourceChanges {
+			if rc.changes() {
+				changes++
+			}
+		}
+		if changes > *guardrails.MaxChanges {
+			violations = append(violations, fmt.Sprintf("plan changes %d resources (max_changes is %d)",
+				changes, *guardrails.MaxChanges))
+		}
+	}
+	for _, rc := range jp.ResourceChanges {
+		var deletes, creates bool
+		for _, action := range rc.Change.Actions {
+			deletes = deletes || action == "delete"
+			creates = creates || action == "create"
+		}
+		if deletes && creates && guardrails.ForbidReplace {
+			violations = append(violations, fmt.Sprintf("plan replaces %s (forbid_replace is set)", rc.Address))
+		}
+		if deletes && matchesAny(rc.Type, guardrails.ForbidDestroyTypes) {
+			violations = append(violations, fmt.Sprintf("plan destroys %s (%s matches forbid_destroy_types)",
+				rc.Address, rc.Type))
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,130 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"strings"
+	"testing"
+)
+
+const testJSONPlan = `{"resource_changes": [
+  {"address": "aws_instance.web", "type": "aws_instance", "change": {"actions": ["delete", "create"]}},
+  {"address": "aws_s3_bucket.logs", "type": "aws_s3_bucket", "change": {"actions": ["delete"]}},
+  {"address": "aws_iam_role.ci", "type": "aws_iam_role", "change": {"actions": ["update"]}}
+]}`
+
+func TestCheckGuardrails(t *testing.T) {
+	limit := 1
+	plan := &tfe.Plan{ID: "plan-1", ResourceAdditions: 1, ResourceChanges: 1, ResourceDestructions: 2}
+
+	t.Run("no guardrails", func(t *testing.T) {
+		r, run := setup(t)
+		if err := r.checkGuardrails(inputJSON{}, &run); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("within limits", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.plans.EXPECT().ReadJSONOutput(gomock.Any(), "plan-1").Return([]byte(testJSONPlan), nil)
+		// the plan counts a replacement as an addition and a destruction, but it's one changed resource
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{
+			MaxDestroy: tfe.Int(2),
+			MaxChanges: tfe.Int(3),
+		}}}
+		if err := r.checkGuardrails(input, &run); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("over limits", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.plans.EXPECT().ReadJSONOutput(gomock.Any(), "plan-1").Return([]byte(testJSONPlan), nil)
+		r.runs.EXPECT().Discard(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{MaxDestroy: &limit, MaxChanges: &limit}}}
+		err := r.checkGuardrails(input, &run)
+		if didntErrorWithSubstr(err, "guardrails failed:\n  - plan destroys 2 resources (max_destroy is 1)\n"+
+			"  - plan changes 3 resources (max_changes is 1)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("forbidden resource changes", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.plans.EXPECT().ReadJSONOutput(gomock.Any(), "plan-1").Return([]byte(testJSONPlan), nil)
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{
+			ForbidReplace:      true,
+			ForbidDestroyTypes: []string{"aws_s3_*"},
+		}}}
+		err := r.checkGuardrails(input, &run)
+		if didntErrorWithSubstr(err, "plan replaces aws_instance.web (forbid_replace is set)\n"+
+			"  - plan destroys aws_s3_bucket.logs (aws_s3_bucket matches forbid_destroy_types)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err != nil && strings.Contains(err.Error(), "aws_iam_role") {
+			t.Errorf("updated resource shouldn't be reported: %s", err)
+		}
+	})
+	t.Run("discard on failure", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), run.ID, tfe.RunDiscardOptions{
+			Comment: tfe.String("Discarded because guardrails failed: plan destroys 2 resources (max_destroy is 1)"),
+		}).Return(nil)
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{MaxDestroy: &limit, Discard: true}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "guardrails failed") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error discarding", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), run.ID, gomock.Any()).Return(fmt.Errorf("NO"))
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{MaxDestroy: &limit, Discard: true}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "error discarding run: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("no plan", func(t *testing.T) {
+		r, run := setup(t)
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{MaxDestroy: &limit}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "run has no plan") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error reading plan", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(nil, fmt.Errorf("NO"))
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{MaxDestroy: &limit}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "error reading plan: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error reading JSON plan", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.plans.EXPECT().ReadJSONOutput(gomock.Any(), "plan-1").Return(nil, fmt.Errorf("NO"))
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{ForbidReplace: true}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "error reading JSON plan: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("invalid JSON plan", func(t *testing.T) {
+		r, run := setup(t)
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(plan, nil)
+		r.plans.EXPECT().ReadJSONOutput(gomock.Any(), "plan-1").Return([]byte("{"), nil)
+		input := inputJSON{Params: paramsJSON{Guardrails: guardrailsJSON{ForbidReplace: true}}}
+		if err := r.checkGuardrails(input, &run); didntErrorWithSubstr(err, "error parsing JSON plan") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
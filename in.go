@@ -1,88 +1,296 @@
 package concourse_tfe_resource
 
 import (
-	"context"
 	"encoding/json"
+	"fmt"
 	tfe "github.com/hashicorp/go-tfe"
-	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 )
 
-func in(input inputJSON) ([]byte, error) {
-	run, err := waitForRun(input)
+const runIDPrefix = "run-"
+
+func (r *Resource) in(input inputJSON) ([]byte, error) {
+	ref, err := r.resolveRun(input.Version.Ref)
+	if err != nil {
+		return nil, err
+	}
+	resolved := ref != input.Version.Ref
+	input.Version.Ref = ref
+	run, err := r.waitForRun(input)
 	if err != nil {
 		return nil, err
 	}
+	if run.ConfigurationVersion != nil && run.ConfigurationVersion.ID != "" {
+		if run.ConfigurationVersion, err = r.getConfigurationVersion(run.ConfigurationVersion.ID); err != nil {
+			return nil, err
+		}
+		if input.Params.DownloadConfig {
+			if err := r.downloadConfiguration(run.ConfigurationVersion.ID, path.Join(r.WorkingDirectory, "config")); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	output := inOutputJSON{Version: version{Ref: input.Version.Ref}}
-	output.Metadata = runMetadata(input, run)
+	policies, err := r.getPolicyResults(run)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := r.getRunTasks(run)
+	if err != nil {
+		return nil, err
+	}
+	if run.CostEstimate, err = r.getCostEstimate(run); err != nil {
+		return nil, err
+	}
+
+	output := inOutputJSON{Version: input.Version}
+	if resolved {
+		// a resolved ref isn't a version check or put would emit, so emit the run's own version instead
+		if output.Version, err = r.readVersion(input, run); err != nil {
+			return nil, err
+		}
+	}
+	output.Metadata = append(runMetadata(input, run), policyMetadata(policies)...)
 
 	metadataMap := make(map[string]string)
 	for _, v := range output.Metadata {
 		metadataMap[v.Name] = v.Value
 	}
-	if err := writeOutputDirectory(input, metadataMap); err != nil {
+	if err := r.writeOutputDirectory(input, run, metadataMap); err != nil {
+		return nil, err
+	}
+	if err := writeAndClose(path.Join(r.WorkingDirectory, "run_id"), []byte(run.ID)); err != nil {
+		return nil, err
+	}
+	if input.Params.WaitFor == waitForPlanned {
+		if err := r.writePlan(run); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.writeJSONFile(policies, "policies.json"); err != nil {
+		return nil, err
+	}
+	if err := r.writeJSONFile(tasks, "run_tasks.json"); err != nil {
+		return nil, err
+	}
+	if run.CostEstimate != nil {
+		if err := r.writeJSONFile(costEstimateOutput(run.CostEstimate), "cost_estimate.json"); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkRunTasks(tasks, input.Params.FailOnRunTasks); err != nil {
 		return nil, err
 	}
 	return json.Marshal(output)
 }
 
-func waitForRun(input inputJSON) (*tfe.Run, error) {
-	var run *tfe.Run
+// resolveRun returns the ID of the run a version refers to. Refs that aren't run IDs are matched against the commit
+// SHAs, then the messages, of the workspace's runs, and resolve to the most recent run for the one commit or message
+// they match.
+func (r *Resource) resolveRun(ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, runIDPrefix) {
+		return ref, nil
+	}
+
+	var commits, messages []*tfe.Run
+	rlo := tfe.RunListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: checkPageSize},
+		Search:      ref,
+		Include:     []tfe.RunIncludeOpt{tfe.RunConfigVer, tfe.RunConfigVerIngress},
+	}
 	for {
-		var err error
-		run, err = client.Runs.Read(context.Background(), input.Version.Ref)
+		runs, err := r.Client.Runs.List(r.Context, r.Workspace.ID, &rlo)
 		if err != nil {
-			return run, formatError(err, "retrieving run")
+			return "", formatError(err, "listing runs")
 		}
-		if needsConfirmation(run) && input.Params.Confirm {
-			err = client.Runs.Apply(context.Background(), input.Version.Ref, tfe.RunApplyOptions{Comment: &input.Params.ApplyMessage})
-			if err != nil {
-				return run, formatError(err, "applying run")
+		for _, run := range runs.Items {
+			if sha := commitSHA(run); sha != "" && strings.HasPrefix(sha, strings.ToLower(ref)) {
+				commits = append(commits, run)
+			} else if strings.Contains(run.Message, ref) {
+				messages = append(messages, run)
 			}
 		}
-		if finished(run) {
+		if len(runs.Items) == 0 || (runs.Pagination != nil && runs.Pagination.NextPage == 0) {
 			break
+		}
+		rlo.PageNumber++
+	}
+
+	matches, describe := commits, commitSHA
+	if len(matches) == 0 {
+		matches, describe = messages, func(run *tfe.Run) string { return fmt.Sprintf("%q", run.Message) }
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("error resolving version: no run's commit SHA or message matches \"%s\"", ref)
+	}
+	// runs are listed newest first
+	for _, run := range matches[1:] {
+		if describe(run) != describe(matches[0]) {
+			return "", fmt.Errorf("error resolving version: \"%s\" is ambiguous, since it matches %s (%s) and %s (%s)",
+				ref, matches[0].ID, describe(matches[0]), run.ID, describe(run))
+		}
+	}
+	r.Logger.Printf("Resolved \"%s\" to run %s", ref, matches[0].ID)
+	return matches[0].ID, nil
+}
+
+func commitSHA(run *tfe.Run) string {
+	if cv := run.ConfigurationVersion; cv != nil && cv.IngressAttributes != nil {
+		return cv.IngressAttributes.CommitSHA
+	}
+	return ""
+}
+
+// runProgress is what waitForRun has already done for a run, kept between polls
+type runProgress struct {
+	overridden bool
+	reported   map[string]tfe.TaskStageStatus
+}
+
+func (r *Resource) waitForRun(input inputJSON) (*tfe.Run, error) {
+	var (
+		run          *tfe.Run
+		done         bool
+		progress     = runProgress{reported: make(map[string]tfe.TaskStageStatus)}
+		failingSince time.Time
+		grace        = time.Duration(input.Source.Retry.GracePeriod) * time.Second
+	)
+	for !done {
+		var err error
+		run, done, err = r.pollRun(input, &progress)
+		if err != nil {
+			// a long apply shouldn't fail because the API was unavailable for a while, whichever request failed
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+			if !transient(err) || time.Since(failingSince) >= grace {
+				return run, err
+			}
+			r.Logger.Printf("Error polling run, will keep trying for up to %s: %s",
+				(grace - time.Since(failingSince)).Round(time.Second), err)
 		} else {
-			log.Printf("Run still in progress (status = %s)", run.Status)
-			time.Sleep(time.Duration(input.Params.PollingPeriod) * time.Second)
+			failingSince = time.Time{}
+		}
+		if !done {
+			if err = r.poll(input); err != nil {
+				return run, err
+			}
 		}
 	}
 	return run, nil
 }
 
-func writeOutputDirectory(input inputJSON, metadataMap map[string]string) error {
-	if err := writeJSONFile(metadataMap, "metadata.json"); err != nil {
+// pollRun reads the run once and moves it along, returning whether there's no need to poll it again
+func (r *Resource) pollRun(input inputJSON, progress *runProgress) (*tfe.Run, bool, error) {
+	run, err := r.Client.Runs.Read(r.Context, input.Version.Ref)
+	if err != nil {
+		return run, false, formatError(err, "retrieving run")
+	}
+	if err = r.reportTaskStages(run, progress.reported); err != nil {
+		return run, false, err
+	}
+	if policiesSoftFailed(run) && input.Params.OverridePolicies && !progress.overridden {
+		if err = r.overridePolicies(input, run); err != nil {
+			return run, false, err
+		}
+		progress.overridden = true
+		return run, false, nil
+	}
+	if r.needsConfirmation(run) && input.Params.WaitFor == waitForPlanned {
+		r.Logger.Printf("Run is waiting for confirmation (status = %s)", run.Status)
+		return run, true, nil
+	}
+	if r.needsConfirmation(run) && input.Params.Confirm {
+		if err = r.checkCostDelta(input, run); err != nil {
+			return run, false, err
+		}
+		if err = r.checkGuardrails(input, run); err != nil {
+			return run, false, err
+		}
+		err = r.Client.Runs.Apply(r.Context, input.Version.Ref, tfe.RunApplyOptions{Comment: &input.Params.ApplyMessage})
+		if err != nil {
+			return run, false, formatError(err, "applying run")
+		}
+	}
+	if finished(run) {
+		return run, true, nil
+	}
+	r.Logger.Printf("Run still in progress (status = %s)", run.Status)
+	return run, false, nil
+}
+
+// poll waits for the polling period before the run is read again, unless the context ends first
+func (r *Resource) poll(input inputJSON) error {
+	select {
+	case <-r.Context.Done():
+		return formatError(r.Context.Err(), "waiting for run")
+	case <-time.After(time.Duration(input.Params.PollingPeriod) * time.Second):
+		return nil
+	}
+}
+
+func (r *Resource) writeOutputDirectory(input inputJSON, run *tfe.Run, metadataMap map[string]string) error {
+	if err := r.writeJSONFile(metadataMap, "metadata.json"); err != nil {
 		return err
 	}
-	if err := writeWorkspaceVariables(); err != nil {
+	if err := r.writeWorkspaceVariables(); err != nil {
 		return err
 	}
-	if err := writeStateOutputs(input.Params.Sensitive); err != nil {
+	if err := r.writeStateOutputs(input.Params); err != nil {
 		return err
 	}
+	if input.Params.DownloadState {
+		if err := r.writeStateFile(input, run); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func writeStateOutputs(sensitive bool) error {
-	outputDir := path.Join(workingDirectory, "outputs")
+// writeStateFile downloads the state written by the run, which is only readable by the owner since it contains every
+// secret terraform knows about
+func (r *Resource) writeStateFile(input inputJSON, run *tfe.Run) error {
+	state, err := r.downloadRunState(input, run)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		if run.Status == tfe.RunApplied {
+			return fmt.Errorf("error downloading state: can't find the state version written by run %s", run.ID)
+		}
+		r.Logger.Printf("Run %s didn't write any state (status = %s), so terraform.tfstate wasn't written", run.ID,
+			run.Status)
+		return nil
+	}
+	return writeAndCloseWithMode(path.Join(r.WorkingDirectory, "terraform.tfstate"), state, os.FileMode(0600))
+}
+
+func (r *Resource) writeStateOutputs(params paramsJSON) error {
+	outputDir := path.Join(r.WorkingDirectory, "outputs")
 	if err := os.MkdirAll(outputDir, os.FileMode(0777)); err != nil {
 		return formatError(err, "creating run output directory")
 	}
 
-	outputs, err := getWorkspaceOutputs()
+	outputs, err := r.getWorkspaceOutputs()
 	if err != nil {
 		return err
 	}
+	if outputs, err = filterOutputs(outputs, params.Outputs); err != nil {
+		return err
+	}
 
 	jsonOutput := make(map[string]json.RawMessage)
 	for _, output := range outputs {
+		if output.Sensitive {
+			r.redactValue(output.Value)
+		}
 		key := output.Name
 		fileName := path.Join(outputDir, key)
 		var outputValue json.RawMessage
-		if !output.Sensitive || sensitive {
+		if !output.Sensitive || params.Sensitive {
 			ov, err := json.Marshal(output.Value)
 			if err != nil {
 				return formatError(err, "marshalling state output")
@@ -94,18 +302,21 @@ func writeStateOutputs(sensitive bool) error {
 			return err
 		}
 	}
-	return writeJSONFile(jsonOutput, "outputs.json")
+	if err := r.writeJSONFile(jsonOutput, "outputs.json"); err != nil {
+		return err
+	}
+	return r.writeOutputFormats(params.OutputFormats, jsonOutput)
 }
 
-func writeWorkspaceVariables() error {
+func (r *Resource) writeWorkspaceVariables() error {
 	var (
 		vars       tfe.VariableList
 		err        error
-		varsDir    = path.Join(workingDirectory, "vars")
-		envVarsDir = path.Join(workingDirectory, "env_vars")
+		varsDir    = path.Join(r.WorkingDirectory, "vars")
+		envVarsDir = path.Join(r.WorkingDirectory, "env_vars")
 		hclVarsDir = path.Join(varsDir, "hcl")
 	)
-	if vars, err = getVariableList(); err != nil {
+	if vars, err = r.getVariableList(); err != nil {
 		return err
 	}
 
@@ -132,20 +343,24 @@ func writeWorkspaceVariables() error {
 	return nil
 }
 
-func writeJSONFile(contents interface{}, fileName string) error {
+func (r *Resource) writeJSONFile(contents interface{}, fileName string) error {
 	byteContents, err := json.Marshal(contents)
 	if err != nil {
 		return formatError(err, "marshaling "+fileName)
 	}
 
-	if err = writeAndClose(path.Join(workingDirectory, fileName), byteContents); err != nil {
+	if err = writeAndClose(path.Join(r.WorkingDirectory, fileName), byteContents); err != nil {
 		return err
 	}
 	return nil
 }
 
 func writeAndClose(fileName string, value []byte) error {
-	f, err := os.Create(fileName)
+	return writeAndCloseWithMode(fileName, value, os.FileMode(0666))
+}
+
+func writeAndCloseWithMode(fileName string, value []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return formatError(err, "creating "+fileName)
 	}
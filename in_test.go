@@ -1,10 +1,16 @@
 package concourse_tfe_resource
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/go-tfe"
 	"go.uber.org/mock/gomock"
+	"io"
+	"log"
 	"math"
 	"os"
 	"path"
@@ -17,7 +23,7 @@ func inSetup() (inputJSON, tfe.VariableList, tfe.StateVersion, []*tfe.StateVersi
 			Workspace: "foo",
 		},
 		Version: version{
-			Ref: "bar",
+			Ref: "run-bar",
 		},
 		Params: paramsJSON{
 			Confirm: true,
@@ -61,25 +67,25 @@ func TestIn(t *testing.T) {
 	wd = path.Join(wd, "test_output")
 
 	t.Run("no params", func(t *testing.T) {
-		run := setup(t)
+		r, run := setup(t)
 		run.Actions.IsConfirmable = true
 		run.HasChanges = true
 		call := 0
 		statuses := []tfe.RunStatus{tfe.RunPending, tfe.RunPlanned, tfe.RunApplied}
-		runs.EXPECT().Read(gomock.Any(), gomock.Any()).Times(3).DoAndReturn(
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Times(3).DoAndReturn(
 			func(_ interface{}, _ string) (*tfe.Run, error) {
 				run.Status = statuses[call]
 				call++
 				return &run, nil
 			})
-		runs.EXPECT().Apply(gomock.Any(), run.ID, gomock.Any()).Return(nil)
-		variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
-		stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), run.ID, gomock.Any()).Return(nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
 
-		workingDirectory = path.Join(wd, "test_in_no_params")
-		os.MkdirAll(workingDirectory, os.FileMode(0755))
+		r.WorkingDirectory = path.Join(wd, "test_in_no_params")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
 
-		output, err := in(input)
+		output, err := r.in(input)
 		if err != nil {
 			t.Error(err)
 		}
@@ -89,22 +95,27 @@ func TestIn(t *testing.T) {
 		for _, v := range vars.Items {
 			var fileName string
 			if v.Category == tfe.CategoryEnv {
-				fileName = path.Join(workingDirectory, "env_vars", v.Key)
+				fileName = path.Join(r.WorkingDirectory, "env_vars", v.Key)
 			} else if v.HCL {
-				fileName = path.Join(workingDirectory, "vars", "hcl", v.Key)
+				fileName = path.Join(r.WorkingDirectory, "vars", "hcl", v.Key)
 			} else {
-				fileName = path.Join(workingDirectory, "vars", v.Key)
+				fileName = path.Join(r.WorkingDirectory, "vars", v.Key)
 			}
 			validateFileContents(t, fileName, v.Value)
 
 		}
 		// non-sensitive var should have its value
-		validateFileContents(t, path.Join(workingDirectory, "outputs", "foo"), "\"foo\"")
+		validateFileContents(t, path.Join(r.WorkingDirectory, "outputs", "foo"), "\"foo\"")
 		// sensitive var should be empty
-		validateFileContents(t, path.Join(workingDirectory, "outputs", "bar"), "")
-		if _, err := os.Stat(path.Join(workingDirectory, "outputs.json")); os.IsNotExist(err) {
+		validateFileContents(t, path.Join(r.WorkingDirectory, "outputs", "bar"), "")
+		if _, err := os.Stat(path.Join(r.WorkingDirectory, "outputs.json")); os.IsNotExist(err) {
 			t.Error("output json file doesn't exist/is in the wrong place")
 		}
+		validateFileContents(t, path.Join(r.WorkingDirectory, "policies.json"), "[]")
+		validateFileContents(t, path.Join(r.WorkingDirectory, "run_id"), run.ID)
+		if _, err := os.Stat(path.Join(r.WorkingDirectory, "cost_estimate.json")); os.IsNotExist(err) {
+			t.Error("cost estimate file wasn't written")
+		}
 		for _, v := range result.Metadata {
 			if v.Name == "cost_delta" && v.Value != "+a billion dollars" {
 				t.Error("bad metadata value")
@@ -112,102 +123,439 @@ func TestIn(t *testing.T) {
 		}
 	})
 	t.Run("sensitive values", func(t *testing.T) {
-		run := setup(t)
+		r, run := setup(t)
 		run.Status = tfe.RunPlannedAndFinished
-		runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
-		variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
-		stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
 
-		workingDirectory = path.Join(wd, "test_in_sensitive")
-		os.MkdirAll(workingDirectory, os.FileMode(0755))
+		r.WorkingDirectory = path.Join(wd, "test_in_sensitive")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
 
 		input.Params.Sensitive = true
-		_, err := in(input)
+		_, err := r.in(input)
+		if err != nil {
+			t.Error(err)
+		}
+
+		validateFileContents(t, path.Join(r.WorkingDirectory, "outputs", "bar"), "\"secretbar\"")
+	})
+	t.Run("override soft-failed policies", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		call := 0
+		statuses := []tfe.RunStatus{tfe.RunPolicyOverride, tfe.RunPolicyChecked, tfe.RunApplied}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Times(3).DoAndReturn(
+			func(_ interface{}, _ string) (*tfe.Run, error) {
+				run.Status = statuses[call]
+				call++
+				return &run, nil
+			})
+		r.comments.EXPECT().Create(gomock.Any(), run.ID, gomock.Any()).Return(&tfe.Comment{}, nil)
+		r.policyChecks.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).Times(2).Return(&tfe.PolicyCheckList{
+			Items: []*tfe.PolicyCheck{
+				{ID: "polchk-1", Status: tfe.PolicySoftFailed, Actions: &tfe.PolicyActions{IsOverridable: true}},
+			}}, nil)
+		r.policyChecks.EXPECT().Override(gomock.Any(), "polchk-1").Return(&tfe.PolicyCheck{}, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), run.ID, gomock.Any()).Return(nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_override_policies")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		overrideInput := input
+		overrideInput.Params.OverridePolicies = true
+		overrideInput.Params.OverrideJustification = "approved"
+		if _, err := r.in(overrideInput); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("override soft-failed OPA policies", func(t *testing.T) {
+		r, run := setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		call := 0
+		statuses := []tfe.RunStatus{tfe.RunPostPlanAwaitingDecision, tfe.RunPostPlanCompleted, tfe.RunApplied}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Times(3).DoAndReturn(
+			func(_ interface{}, _ string) (*tfe.Run, error) {
+				run.Status = statuses[call]
+				call++
+				return &run, nil
+			})
+		awaiting := &tfe.TaskStageList{Items: []*tfe.TaskStage{
+			{ID: "ts-1", Stage: tfe.PostPlan, Status: tfe.TaskStageAwaitingOverride},
+		}}
+		passed := &tfe.TaskStageList{Items: []*tfe.TaskStage{
+			{ID: "ts-1", Stage: tfe.PostPlan, Status: tfe.TaskStagePassed},
+		}}
+		gomock.InOrder(
+			r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).Times(2).Return(awaiting, nil),
+			r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).AnyTimes().Return(passed, nil),
+		)
+		r.taskStages.EXPECT().Read(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(&tfe.TaskStage{}, nil)
+		r.comments.EXPECT().Create(gomock.Any(), run.ID, gomock.Any()).Return(&tfe.Comment{}, nil)
+		r.taskStages.EXPECT().Override(gomock.Any(), "ts-1", gomock.Any()).Return(&tfe.TaskStage{}, nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_override_opa_policies")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		overrideInput := input
+		overrideInput.Params.OverridePolicies = true
+		overrideInput.Params.OverrideJustification = "approved"
+		if _, err := r.in(overrideInput); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("transient error reporting run tasks", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunApplied
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Times(2).Return(&run, nil)
+		gomock.InOrder(
+			r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).
+				Return(nil, &retryError{attempts: 3, err: fmt.Errorf("502 Bad Gateway")}),
+			r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).AnyTimes().Return(&tfe.TaskStageList{}, nil),
+		)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_transient_run_tasks")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		graceful := input
+		graceful.Source.Retry.GracePeriod = 60
+		if _, err := r.in(graceful); err != nil {
+			t.Error(err)
+		}
+
+		// without a grace period, the same failure fails the get
+		r, run = setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).
+			Return(nil, &retryError{attempts: 3, err: fmt.Errorf("502 Bad Gateway")})
+		if _, err := r.in(input); didntErrorWithSubstr(err, "502 Bad Gateway") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("failed run tasks", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunPlannedAndFinished
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.taskStages.EXPECT().List(gomock.Any(), run.ID, gomock.Any()).Times(3).Return(
+			&tfe.TaskStageList{Items: []*tfe.TaskStage{{ID: "ts-1", Status: tfe.TaskStagePassed}}}, nil)
+		r.taskStages.EXPECT().Read(gomock.Any(), "ts-1", gomock.Any()).Return(testTaskStage(), nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_run_tasks")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		taskInput := input
+		taskInput.Params.FailOnRunTasks = []string{"advisory"}
+		if _, err := r.in(taskInput); didntErrorWithSubstr(err, "scanner (post_plan, advisory): found 3 issues") {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if _, err := os.Stat(path.Join(r.WorkingDirectory, "run_tasks.json")); os.IsNotExist(err) {
+			t.Error("run tasks file wasn't written")
+		}
+	})
+	t.Run("cost delta over threshold", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunPlanned
+		run.CostEstimate = &tfe.CostEstimate{ID: "ce-1"}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.costEstimates.EXPECT().Read(gomock.Any(), "ce-1").Return(
+			&tfe.CostEstimate{Status: tfe.CostEstimateFinished, DeltaMonthlyCost: "250.00"}, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		limit := 100.0
+		costInput := input
+		costInput.Params.MaxMonthlyCostDelta = &limit
+		if _, err := r.in(costInput); didntErrorWithSubstr(err, "exceeds max_monthly_cost_delta") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("wait for planned", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunPlanned
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(&tfe.Plan{
+			ID:                "plan-1",
+			Status:            tfe.PlanFinished,
+			HasChanges:        true,
+			ResourceAdditions: 2,
+		}, nil)
+		r.plans.EXPECT().Logs(gomock.Any(), "plan-1").Return(bytes.NewReader([]byte("Plan: 2 to add")), nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_wait_for_planned")
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		plannedInput := input
+		plannedInput.Params.Confirm = false
+		plannedInput.Params.WaitFor = waitForPlanned
+		if _, err := r.in(plannedInput); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		validateFileContents(t, path.Join(r.WorkingDirectory, "plan.log"), "Plan: 2 to add")
+		validateFileContents(t, path.Join(r.WorkingDirectory, "plan.json"), `{"status":"finished","has_changes":true,`+
+			`"resource_additions":2,"resource_changes":0,"resource_destructions":0,"resource_imports":0}`)
+	})
+	t.Run("guardrail failure", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunPlanned
+		run.Plan = &tfe.Plan{ID: "plan-1"}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.plans.EXPECT().Read(gomock.Any(), "plan-1").Return(&tfe.Plan{ID: "plan-1", ResourceDestructions: 3}, nil)
+		r.runs.EXPECT().Apply(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		guardedInput := input
+		guardedInput.Params.Guardrails = guardrailsJSON{MaxDestroy: tfe.Int(0)}
+		if _, err := r.in(guardedInput); didntErrorWithSubstr(err, "plan destroys 3 resources (max_destroy is 0)") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("download state", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunApplied
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+		r.stateVersions.EXPECT().ReadCurrent(gomock.Any(), "foo").Return(
+			&tfe.StateVersion{DownloadURL: "/state", Run: &tfe.Run{ID: run.ID}}, nil)
+		r.stateVersions.EXPECT().Download(gomock.Any(), "/state").Return([]byte(`{"version":4}`), nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_download_state")
+		os.RemoveAll(r.WorkingDirectory)
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		stateInput := input
+		stateInput.Params.DownloadState = true
+		if _, err := r.in(stateInput); err != nil {
+			t.Error(err)
+		}
+
+		fileName := path.Join(r.WorkingDirectory, "terraform.tfstate")
+		validateFileContents(t, fileName, `{"version":4}`)
+		if s, err := os.Stat(fileName); err != nil || s.Mode().Perm() != os.FileMode(0600) {
+			t.Errorf("state file has the wrong permissions: %v", s)
+		}
+	})
+	t.Run("download config", func(t *testing.T) {
+		r, run := setup(t)
+		run.Status = tfe.RunApplied
+		run.ConfigurationVersion = &tfe.ConfigurationVersion{ID: "cv-123"}
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.configVersions.EXPECT().ReadWithOptions(gomock.Any(), "cv-123", gomock.Any()).Return(&tfe.ConfigurationVersion{
+			ID:     "cv-123",
+			Source: tfe.ConfigurationSourceGithub,
+			IngressAttributes: &tfe.IngressAttributes{
+				CommitSHA: "abc123",
+				Branch:    "main",
+				CommitURL: "https://github.com/org/repo/commit/abc123",
+			},
+		}, nil)
+		r.configVersions.EXPECT().Download(gomock.Any(), "cv-123").Return(testSlug(t, "main.tf", "# config"), nil)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+
+		r.WorkingDirectory = path.Join(wd, "test_in_download_config")
+		os.RemoveAll(r.WorkingDirectory)
+		os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+		configInput := input
+		configInput.Params.DownloadConfig = true
+		output, err := r.in(configInput)
 		if err != nil {
 			t.Error(err)
 		}
 
-		validateFileContents(t, path.Join(workingDirectory, "outputs", "bar"), "\"secretbar\"")
+		validateFileContents(t, path.Join(r.WorkingDirectory, "config", "main.tf"), "# config")
+		var result inOutputJSON
+		json.Unmarshal(output, &result)
+		expected := map[string]string{
+			"configuration_version": "cv-123",
+			"commit_sha":            "abc123",
+			"branch":                "main",
+			"commit_url":            "https://github.com/org/repo/commit/abc123",
+		}
+		for _, v := range result.Metadata {
+			if e, ok := expected[v.Name]; ok && e != v.Value {
+				t.Errorf("bad metadata value for %s: %s", v.Name, v.Value)
+			}
+			delete(expected, v.Name)
+		}
+		if len(expected) > 0 {
+			t.Errorf("missing metadata: %v", expected)
+		}
 	})
 	t.Run("error retrieving run", func(t *testing.T) {
-		run := setup(t)
-		runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, fmt.Errorf("foo"))
+		r, run := setup(t)
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, fmt.Errorf("foo"))
 
-		_, err := in(input)
+		_, err := r.in(input)
 		if err.Error() != "error retrieving run: foo" {
 			t.Errorf("unexpected error: %s", err)
 		}
 	})
+	t.Run("canceled while waiting", func(t *testing.T) {
+		r, run := setup(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r.Context = ctx
+		r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+
+		waiting := input
+		waiting.Params.PollingPeriod = 3600
+		if _, err := r.in(waiting); didntErrorWithSubstr(err, "error waiting for run: context canceled") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestResolveRun(t *testing.T) {
+	fake := newFakeTFE(t)
+	var runs []*tfe.Run
+	for _, commit := range []struct{ message, sha string }{
+		{"Deploy v1", "0123abcd0123abcd0123abcd0123abcd0123abcd"},
+		{"Deploy v1 again", "0123abcd0123abcd0123abcd0123abcd0123abcd"},
+		{"Deploy v2", "0456efab0456efab0456efab0456efab0456efab"},
+	} {
+		run := fake.addRun(commit.message, tfe.RunApplied)
+		run.ConfigurationVersion.IngressAttributes = &tfe.IngressAttributes{ID: "ia-" + run.ID, CommitSHA: commit.sha}
+		runs = append(runs, run)
+	}
+	r := &Resource{Context: context.Background(), Logger: log.New(io.Discard, "", 0)}
+	if err := r.startup(inputJSON{Source: fake.source()}); err != nil {
+		t.Fatalf("startup failed: %s", err)
+	}
+
+	tests := []struct {
+		ref      string
+		expected string
+		err      string
+	}{
+		{ref: runs[0].ID, expected: runs[0].ID},
+		{ref: "0123ABCD", expected: runs[1].ID},
+		{ref: "v2", expected: runs[2].ID},
+		{ref: "again", expected: runs[1].ID},
+		{ref: "0", err: "\"0\" is ambiguous, since it matches " + runs[2].ID + " (0456efab"},
+		{ref: "Deploy v1", err: "\"Deploy v1\" is ambiguous, since it matches " + runs[1].ID + " (\"Deploy v1 again\")"},
+		{ref: "v3", err: "no run's commit SHA or message matches \"v3\""},
+	}
+	for _, test := range tests {
+		id, err := r.resolveRun(test.ref)
+		if test.err != "" && didntErrorWithSubstr(err, test.err) {
+			t.Errorf("expected error containing %q for %q, got %s", test.err, test.ref, err)
+		} else if test.err == "" && (err != nil || id != test.expected) {
+			t.Errorf("expected %q to resolve to %s, got %q / %s", test.ref, test.expected, id, err)
+		}
+	}
+
+	// the resolved run's version is emitted with its version fields, the same as check finds it
+	source := fake.source()
+	source.VersionFields = []string{versionFieldCreatedAt, versionFieldCommitSHA}
+	request, _ := json.Marshal(inputJSON{Source: source, Params: paramsJSON{PollingPeriod: 1},
+		Version: version{Ref: "0456efab"}})
+	output, err := (&Resource{WorkingDirectory: t.TempDir()}).In(bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("in failed: %s", err)
+	}
+	var result inOutputJSON
+	_ = json.Unmarshal(output, &result)
+	if expected := source.runVersion(runs[2]); result.Version != expected || expected.CommitSHA == "" {
+		t.Errorf("in emitted %+v, expected the resolved run's version %+v", result.Version, expected)
+	}
 }
 
 func TestWritingFunctionErrors(t *testing.T) {
-	run := setup(t)
+	r, run := setup(t)
 	input, vars, sv, _ := inSetup()
 
 	wd, _ := os.Getwd()
-	workingDirectory = path.Join(wd, "test_output", "test_unwriteable")
-	os.RemoveAll(workingDirectory)
-	os.MkdirAll(workingDirectory, os.FileMode(0444))
+	r.WorkingDirectory = path.Join(wd, "test_output", "test_unwriteable")
+	os.RemoveAll(r.WorkingDirectory)
+	os.MkdirAll(r.WorkingDirectory, os.FileMode(0444))
 
-	err := writeStateOutputs(true)
+	err := r.writeStateOutputs(paramsJSON{Sensitive: true})
 	if didntErrorWithSubstr(err, "creating run output directory") {
 		t.Errorf("expected error creating directory, got %s", err)
 	}
-	_ = os.Chmod(workingDirectory, os.FileMode(0755))
-	_ = os.MkdirAll(path.Join(workingDirectory, "outputs"), os.FileMode(0555))
-	_ = os.Chmod(workingDirectory, os.FileMode(0555))
-	stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, fmt.Errorf("NO"))
-	err = writeStateOutputs(true)
+	_ = os.Chmod(r.WorkingDirectory, os.FileMode(0755))
+	_ = os.MkdirAll(path.Join(r.WorkingDirectory, "outputs"), os.FileMode(0555))
+	_ = os.Chmod(r.WorkingDirectory, os.FileMode(0555))
+	r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, fmt.Errorf("NO"))
+	err = r.writeStateOutputs(paramsJSON{Sensitive: true})
 	if didntErrorWithSubstr(err, "getting current workspace state") {
 		t.Errorf("expected error retrieving state, got %s", err)
 	}
-	stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
-	err = writeStateOutputs(true)
+	r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(&sv, nil)
+	err = r.writeStateOutputs(paramsJSON{Sensitive: true})
 	if didntErrorWithSubstr(err, "creating ") {
 		t.Errorf("expected error creating output file, got %s", err)
 	}
 
-	variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
-	err = writeWorkspaceVariables()
+	r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+	err = r.writeWorkspaceVariables()
 	if didntErrorWithSubstr(err, "creating output directories") {
 		t.Errorf("expected error creating directory, got %s", err)
 	}
-	_ = os.Chmod(workingDirectory, os.FileMode(0755))
-	_ = os.MkdirAll(path.Join(workingDirectory, "vars", "hcl"), os.FileMode(0444))
-	_ = os.MkdirAll(path.Join(workingDirectory, "env_vars"), os.FileMode(0444))
-	_ = os.Chmod(workingDirectory, os.FileMode(0444))
-	variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, fmt.Errorf("NO"))
-	err = writeWorkspaceVariables()
+	_ = os.Chmod(r.WorkingDirectory, os.FileMode(0755))
+	_ = os.MkdirAll(path.Join(r.WorkingDirectory, "vars", "hcl"), os.FileMode(0444))
+	_ = os.MkdirAll(path.Join(r.WorkingDirectory, "env_vars"), os.FileMode(0444))
+	_ = os.Chmod(r.WorkingDirectory, os.FileMode(0444))
+	r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, fmt.Errorf("NO"))
+	err = r.writeWorkspaceVariables()
 	if didntErrorWithSubstr(err, "retrieving workspace variables") {
 		t.Errorf("expected error listing vars, got %s", err)
 	}
-	variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
-	err = writeWorkspaceVariables()
+	r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&vars, nil)
+	err = r.writeWorkspaceVariables()
 	if didntErrorWithSubstr(err, "creating ") {
 		t.Errorf("expected error writing var file, got %s", err)
 	}
 
-	err = writeJSONFile(math.Inf(1), "infinite.json")
+	err = r.writeJSONFile(math.Inf(1), "infinite.json")
 	if didntErrorWithSubstr(err, "marshaling infinite.json") {
 		t.Errorf("expected marshalling error, got %s", err)
 	}
-	err = writeJSONFile(input, "infinite.json")
+	err = r.writeJSONFile(input, "infinite.json")
 	if didntErrorWithSubstr(err, "creating ") {
 		t.Errorf("expected marshalling error, got %s", err)
 	}
 
 	run.Status = tfe.RunPlannedAndFinished
-	runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
-	if _, err = in(input); didntErrorWithSubstr(err, "creating ") {
+	r.runs.EXPECT().Read(gomock.Any(), gomock.Any()).Return(&run, nil)
+	if _, err = r.in(input); didntErrorWithSubstr(err, "creating ") {
 		t.Errorf("expected error writing file, got %s", err)
 	}
 
 	// don't leave files with messed up permissions
-	_ = os.Chmod(workingDirectory, os.FileMode(0755))
-	_ = os.Chmod(path.Join(workingDirectory, "vars"), os.FileMode(0755))
-	_ = os.Chmod(path.Join(workingDirectory, "env_vars"), os.FileMode(0755))
-	_ = os.Chmod(path.Join(workingDirectory, "vars", "hcl"), os.FileMode(0755))
-	_ = os.Chmod(path.Join(workingDirectory, "outputs"), os.FileMode(0755))
+	_ = os.Chmod(r.WorkingDirectory, os.FileMode(0755))
+	_ = os.Chmod(path.Join(r.WorkingDirectory, "vars"), os.FileMode(0755))
+	_ = os.Chmod(path.Join(r.WorkingDirectory, "env_vars"), os.FileMode(0755))
+	_ = os.Chmod(path.Join(r.WorkingDirectory, "vars", "hcl"), os.FileMode(0755))
+	_ = os.Chmod(path.Join(r.WorkingDirectory, "outputs"), os.FileMode(0755))
+}
+
+func testSlug(t *testing.T, name string, contents string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tw.Write([]byte(contents))
+	_ = tw.Close()
+	_ = gz.Close()
+	return buf.Bytes()
 }
 
 func validateFileContents(t *testing.T, fileName string, expectedValue string) {
@@ -0,0 +1,187 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	logLevel int
+
+	// logWriter filters, formats and redacts the resource's log. A message's level comes from its prefix, like
+	// "DEBUG: ", and messages without one are info.
+	logWriter struct {
+		out      io.Writer
+		level    logLevel
+		json     bool
+		mu       sync.Mutex
+		secrets  []string
+		replacer *strings.Replacer
+	}
+
+	// traceTransport logs each API request and its response at debug level. Bodies aren't logged, since state and
+	// variables pass through them, and neither are URLs other than API paths.
+	traceTransport struct {
+		base   http.RoundTripper
+		logger *log.Logger
+		// the host of the Terraform Cloud address, whose API paths are safe to log
+		apiHost string
+	}
+)
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// shorter values aren't redacted, since masking every "1" or "true" would make the log unreadable
+	minSecretLength = 4
+	redacted        = "***"
+)
+
+var (
+	logLevels = map[string]logLevel{
+		"debug": levelDebug,
+		"info":  levelInfo,
+		"warn":  levelWarn,
+		"error": levelError,
+	}
+	levelNames    = []string{"debug", "info", "warn", "error"}
+	levelPrefixes = map[string]logLevel{
+		"DEBUG: ":   levelDebug,
+		"WARNING: ": levelWarn,
+		"ERROR: ":   levelError,
+	}
+)
+
+// configureLogging applies the source's log settings to the resource's logger, keeping its output and anything
+// already redacted from it
+func (r *Resource) configureLogging(source sourceJSON) {
+	var secrets []string
+	out := r.Logger.Writer()
+	if existing, ok := out.(*logWriter); ok {
+		out, secrets = existing.out, existing.secrets
+	}
+	level, ok := logLevels[source.LogLevel]
+	if !ok {
+		level = levelInfo
+	}
+	r.logs = &logWriter{out: out, level: level, json: source.LogFormat == logFormatJSON}
+	if len(secrets) > 0 {
+		r.logs.secrets = secrets
+		r.logs.replacer = strings.NewReplacer(secrets...)
+	}
+	r.Logger = log.New(r.logs, "", 0)
+}
+
+// redact masks values in everything logged from now on
+func (r *Resource) redact(values ...string) {
+	if r.logs != nil {
+		r.logs.redact(values...)
+	}
+}
+
+// redactValue masks a state output or variable value, along with every string inside it
+func (r *Resource) redactValue(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		r.redact(v)
+		return
+	case map[string]interface{}:
+		for _, element := range v {
+			r.redactValue(element)
+		}
+	case []interface{}:
+		for _, element := range v {
+			r.redactValue(element)
+		}
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		r.redact(string(encoded))
+	}
+}
+
+func (r *Resource) debugging() bool {
+	return r.logs != nil && r.logs.level == levelDebug
+}
+
+func (w *logWriter) redact(values ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			w.secrets = append(w.secrets, value, redacted)
+		}
+	}
+	w.replacer = strings.NewReplacer(w.secrets...)
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := levelInfo
+	for prefix, prefixLevel := range levelPrefixes {
+		if strings.HasPrefix(message, prefix) {
+			level = prefixLevel
+			if w.json {
+				message = strings.TrimPrefix(message, prefix)
+			}
+		}
+	}
+	if level < w.level {
+		return len(p), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.replacer != nil {
+		message = w.replacer.Replace(message)
+	}
+	var line []byte
+	if w.json {
+		line, _ = json.Marshal(map[string]string{
+			"time":    time.Now().Format(time.RFC3339),
+			"level":   levelNames[level],
+			"message": message,
+		})
+	} else {
+		line = []byte(time.Now().Format("2006/01/02 15:04:05 ") + message)
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	target := logTarget(req.URL, t.apiHost)
+	t.logger.Printf("DEBUG: %s %s", req.Method, target)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.logger.Printf("DEBUG: %s %s failed after %s: %s", req.Method, target, time.Since(start).Round(time.Millisecond),
+			err)
+		return resp, err
+	}
+	t.logger.Printf("DEBUG: %s %s returned %s in %s (request id %s)", req.Method, target, resp.Status,
+		time.Since(start).Round(time.Millisecond), resp.Header.Get("X-Request-Id"))
+	return resp, nil
+}
+
+// logTarget is what's logged for a request's URL: the path of an API request, without its query, or just the host
+// for anything else. State and configuration downloads use signed URLs which anyone could use without a token.
+func logTarget(u *url.URL, apiHost string) string {
+	if u.Host == apiHost && strings.HasPrefix(u.Path, "/api/") {
+		return u.Path
+	}
+	return u.Host + "/***"
+}
@@ -0,0 +1,140 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/go-tfe"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	var logOutput bytes.Buffer
+	r := &Resource{Logger: log.New(&logOutput, "", log.LstdFlags)}
+	r.configureLogging(sourceJSON{LogLevel: "warn"})
+
+	r.Logger.Print("DEBUG: hidden")
+	r.Logger.Print("hidden too")
+	r.Logger.Print("WARNING: shown")
+	r.Logger.Printf("ERROR: failed with %s", "secret-value")
+	if strings.Contains(logOutput.String(), "hidden") {
+		t.Errorf("logged messages below the log level: %s", logOutput.String())
+	}
+	if !strings.Contains(logOutput.String(), " WARNING: shown\n") {
+		t.Errorf("didn't log warning: %s", logOutput.String())
+	}
+
+	logOutput.Reset()
+	r.redact("secret-value", "abc")
+	r.redact("")
+	r.Logger.Printf("ERROR: failed with %s (abc)", "secret-value")
+	if !strings.HasSuffix(logOutput.String(), " ERROR: failed with *** (abc)\n") {
+		t.Errorf("didn't redact secret: %s", logOutput.String())
+	}
+
+	// configuring again keeps the original output, rather than wrapping the last logger
+	logOutput.Reset()
+	r.configureLogging(sourceJSON{LogLevel: "debug", LogFormat: logFormatJSON})
+	if r.logs.out != &logOutput {
+		t.Error("reconfiguring wrapped the previous log writer")
+	}
+	r.Logger.Print("DEBUG: GET /api/v2/ping")
+	var line map[string]string
+	if err := json.Unmarshal(logOutput.Bytes(), &line); err != nil {
+		t.Fatalf("log line isn't JSON: %s", logOutput.String())
+	}
+	if line["level"] != "debug" || line["message"] != "GET /api/v2/ping" || line["time"] == "" {
+		t.Errorf("unexpected JSON log line: %v", line)
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	var logOutput bytes.Buffer
+	r := &Resource{Logger: log.New(&logOutput, "", 0)}
+	r.redactValue("ignored without a log writer")
+	r.configureLogging(sourceJSON{})
+	r.redactValue(map[string]interface{}{"password": "hunter22", "hosts": []interface{}{"db-1.internal", 5432.0}})
+	r.Logger.Print(`connecting to db-1.internal with hunter22, {"hosts":["db-1.internal",5432],"password":"hunter22"}`)
+	if expected := "connecting to *** with ***, ***\n"; !strings.HasSuffix(logOutput.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, logOutput.String())
+	}
+}
+
+func TestDebugTracing(t *testing.T) {
+	fake := newFakeTFE(t)
+	fake.addRun("TestDebugTracing")
+	source := fake.source()
+	source.LogLevel = "debug"
+	request, _ := json.Marshal(inputJSON{Source: source, Params: paramsJSON{PollingPeriod: 1}})
+
+	var logOutput bytes.Buffer
+	r := &Resource{Logger: log.New(&logOutput, "", 0)}
+	if _, err := r.Check(bytes.NewReader(request)); err != nil {
+		t.Fatalf("check failed: %s", err)
+	}
+	if !strings.Contains(logOutput.String(), "DEBUG: GET /api/v2/workspaces/ws-fake/runs") ||
+		!strings.Contains(logOutput.String(), "returned 200 OK in") {
+		t.Errorf("requests weren't traced: %s", logOutput.String())
+	}
+	if strings.Contains(logOutput.String(), fakeToken) {
+		t.Errorf("token was logged: %s", logOutput.String())
+	}
+}
+
+func TestLogTarget(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"https://app.terraform.io/api/v2/runs/run-1?include=plan":        "/api/v2/runs/run-1",
+		"https://archivist.terraform.io/v1/object/c2lnbmVk?token=secret": "archivist.terraform.io/***",
+		"https://app.terraform.io/_archivist/v1/object/c2lnbmVk":         "app.terraform.io/***",
+	} {
+		u, _ := url.Parse(raw)
+		if target := logTarget(u, "app.terraform.io"); target != expected {
+			t.Errorf("expected %s to be logged as %s, got %s", raw, expected, target)
+		}
+	}
+}
+
+func TestRedactSensitiveValues(t *testing.T) {
+	fake := newFakeTFE(t)
+	fake.outputs = []*tfe.StateVersionOutput{
+		{ID: "wsout-password", Name: "password", Type: "string", Value: "output-secret", Sensitive: true},
+		{ID: "wsout-host", Name: "host", Type: "string", Value: "db.internal"},
+	}
+	fake.variables = []*tfe.Variable{{ID: "var-key", Key: "key", Category: tfe.CategoryTerraform, Sensitive: true}}
+	dir := path.Join("test_output", "test_redact")
+	_ = os.RemoveAll(dir)
+	_ = os.MkdirAll(dir, os.FileMode(0755))
+
+	var logOutput bytes.Buffer
+	r := &Resource{Logger: log.New(&logOutput, "", 0), WorkingDirectory: dir}
+	request, _ := json.Marshal(inputJSON{
+		Source: fake.source(),
+		Params: paramsJSON{PollingPeriod: 1, Vars: map[string]variableJSON{
+			"key":      {Value: "updated-secret", Category: tfe.CategoryTerraform},
+			"password": {Value: "created-secret", Category: tfe.CategoryTerraform, Sensitive: tfe.Bool(true)},
+			"region":   {Value: "eu-west-1", Category: tfe.CategoryTerraform},
+		}},
+	})
+	output, err := r.Out(bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("out failed: %s", err)
+	}
+	var outResult struct{ Version version }
+	_ = json.Unmarshal(output, &outResult)
+	fake.runs[0].script = []tfe.RunStatus{tfe.RunApplied}
+	request, _ = json.Marshal(inputJSON{Source: fake.source(), Params: paramsJSON{PollingPeriod: 1},
+		Version: outResult.Version})
+	if _, err = r.In(bytes.NewReader(request)); err != nil {
+		t.Fatalf("in failed: %s", err)
+	}
+
+	logOutput.Reset()
+	r.Logger.Print("updated-secret created-secret output-secret eu-west-1 db.internal")
+	if expected := "*** *** *** eu-west-1 db.internal\n"; !strings.HasSuffix(logOutput.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, logOutput.String())
+	}
+}
@@ -2,56 +2,33 @@ package concourse_tfe_resource
 
 import (
 	"context"
-	tfe "github.com/hashicorp/go-tfe"
 	"io"
 	"log"
 	"os"
 	"path"
 )
 
-var client *tfe.Client
-var workspace *tfe.Workspace
-var workingDirectory string
-
-func startup(input inputJSON) error {
-	config := &tfe.Config{
-		Token:   input.Source.Token,
-		Address: input.Source.Address,
-	}
-	var err error
-	client, err = tfe.NewClient(config)
-	if err != nil {
-		return formatError(err, "creating tfe client")
-	}
-
-	workspace, err = client.Workspaces.Read(context.Background(),
-		input.Source.Organization,
-		input.Source.Workspace)
-	if err != nil {
-		return formatError(err, "getting workspace")
-	}
-	return nil
-}
-
 func realMain(args []string, stdin io.Reader) ([]byte, error) {
-	var output []byte
-	input, err := getInputs(stdin)
-	if err != nil {
-		return nil, err
-	}
-	if err := startup(input); err != nil {
-		return nil, err
-	}
-
+	var (
+		r      = &Resource{Context: context.Background(), Logger: log.Default()}
+		output []byte
+		err    error
+	)
 	switch path.Base(args[0]) {
 	case "check":
-		output, err = check(input)
+		output, err = r.Check(stdin)
 	case "in":
-		workingDirectory = args[1]
-		output, err = in(input)
+		r.WorkingDirectory = args[1]
+		output, err = r.In(stdin)
 	case "out":
-		workingDirectory = args[1]
-		output, err = out(input)
+		r.WorkingDirectory = args[1]
+		output, err = r.Out(stdin)
+	default:
+		_, err = r.prepare(stdin)
+	}
+	if err != nil {
+		// logged here rather than by main, so it's formatted and redacted like everything else
+		r.Logger.Printf("ERROR: %s", err)
 	}
 	return output, err
 }
@@ -59,7 +36,7 @@ func realMain(args []string, stdin io.Reader) ([]byte, error) {
 func main() {
 	output, err := realMain(os.Args, os.Stdin)
 	if err != nil {
-		log.Fatal(err)
+		os.Exit(1)
 	}
 	_, _ = os.Stdout.Write(output)
 }
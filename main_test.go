@@ -2,7 +2,9 @@ package concourse_tfe_resource
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"github.com/hashicorp/go-tfe"
 	"os"
 	"path"
 	"strings"
@@ -10,43 +12,57 @@ import (
 )
 
 func TestStartup(t *testing.T) {
+	fake := newFakeTFE(t)
 	input := inputJSON{
-		Source:  sourceJSON{},
+		Source:  sourceJSON{Address: fake.URL},
 		Params:  paramsJSON{},
 		Version: version{},
 	}
 
-	err := startup(input)
+	r := &Resource{Context: context.Background()}
+	err := r.startup(input)
 	if err == nil || !strings.Contains(err.Error(), "creating tfe client") {
 		t.Errorf("no/bad error creating client with empty config: %s", err)
 	}
 
-	input.Source.Token = os.Getenv("ATLAS_TOKEN")
-	err = startup(input)
+	input.Source.Token = fakeToken
+	err = r.startup(input)
 
 	if err == nil || !strings.Contains(err.Error(), "getting workspace") {
 		t.Errorf("no/bad error without org/workspace set: %s", err)
 	}
 
-	input.Source.Workspace = os.Getenv("TFE_WORKSPACE")
-	input.Source.Organization = os.Getenv("TFE_ORGANIZATION")
-
-	err = startup(input)
+	input.Source = fake.source()
+	err = r.startup(input)
 	if err != nil {
 		t.Errorf("startup failed with valid config: %s", err)
 	}
+	if r.Workspace.ID != fake.workspace.ID {
+		t.Errorf("startup read the wrong workspace: %s", r.Workspace.ID)
+	}
+
+	input.Source.Token = "wrong"
+	r = &Resource{Context: context.Background()}
+	err = r.startup(input)
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("no/bad error with a bad token: %s", err)
+	}
 }
 
 func TestRealMain(t *testing.T) {
+	fake := newFakeTFE(t)
+	fake.stateFile = []byte(`{"version":4}`)
+	fake.outputs = []*tfe.StateVersionOutput{
+		{ID: "wsout-simple", Name: "simple", Type: "string", Value: "value"},
+		{ID: "wsout-complex", Name: "complex", Type: "object", Value: map[string]interface{}{"a": []interface{}{1.0, 2.0}}},
+	}
+	fake.variables = []*tfe.Variable{{ID: "var-existing", Key: "existing", Value: "old", Category: tfe.CategoryTerraform}}
+	fake.addRun("an old run", tfe.RunApplied)
+
 	input := inputJSON{
-		Source: sourceJSON{
-			Workspace:    os.Getenv("TFE_WORKSPACE"),
-			Organization: os.Getenv("TFE_ORGANIZATION"),
-			Token:        os.Getenv("ATLAS_TOKEN"),
-			Address:      os.Getenv("TFE_ADDRESS"),
-		},
+		Source: fake.source(),
 		Params: paramsJSON{
-			PollingPeriod: 5,
+			PollingPeriod: 1,
 		},
 	}
 
@@ -59,24 +75,118 @@ func TestRealMain(t *testing.T) {
 	}
 
 	wd, _ := os.Getwd()
-	_ = os.Mkdir(path.Join(wd, "test_output", "test_main_in"), os.FileMode(0755))
+	dir := path.Join("test_output", "test_main_in")
+	_ = os.RemoveAll(path.Join(wd, dir))
+	_ = os.MkdirAll(path.Join(wd, dir), os.FileMode(0755))
 	run := make([]version, 1)
 	_ = json.Unmarshal(output, &run)
-	args = []string{"in", path.Join("test_output", "test_main_in")}
+	args = []string{"in", dir}
 	input.Version = version{Ref: run[0].Ref}
+	input.Params.DownloadState = true
+	input.Params.Sensitive = true
 	byteInput, _ = json.Marshal(input)
 	_, err = realMain(args, bytes.NewReader(byteInput))
 
 	if err != nil {
 		t.Errorf("in on checked run failed: %s", err)
 	}
+	validateFileContents(t, path.Join(wd, dir, "terraform.tfstate"), `{"version":4}`)
 
 	args[0] = "out"
 	input.Params.Message = "TestRealMain out test"
+	input.Params.DownloadState = false
+	input.Params.Sensitive = false
+	input.Params.Vars = map[string]variableJSON{
+		"existing": {Value: "new", Category: tfe.CategoryTerraform},
+		"added":    {Value: "value", Category: tfe.CategoryTerraform, Sensitive: tfe.Bool(true)},
+	}
 	byteInput, _ = json.Marshal(input)
-	_, err = realMain(args, bytes.NewReader(byteInput))
+	output, err = realMain(args, bytes.NewReader(byteInput))
 
 	if err != nil {
 		t.Errorf("out failed: %s", err)
 	}
+	if len(fake.variables) != 2 || fake.variables[0].Value != "new" || !fake.variables[1].Sensitive {
+		t.Errorf("out didn't push variables: %+v", fake.variables)
+	}
+
+	// the run queued by out waits for confirmation; confirming it from in should apply it
+	var outResult struct{ Version version }
+	_ = json.Unmarshal(output, &outResult)
+	args[0] = "in"
+	input.Version = outResult.Version
+	input.Params = paramsJSON{Confirm: true, PollingPeriod: 1}
+	byteInput, _ = json.Marshal(input)
+	_, err = realMain(args, bytes.NewReader(byteInput))
+
+	if err != nil {
+		t.Errorf("in with confirm failed: %s", err)
+	}
+	if status := fake.runs[0].run.Status; status != tfe.RunApplied {
+		t.Errorf("confirmed run finished as %s, expected applied", status)
+	}
+}
+
+func TestRealMainOverridePolicies(t *testing.T) {
+	fake := newFakeTFE(t)
+	fake.softFailPolicies = true
+	dir := path.Join("test_output", "test_main_override")
+	_ = os.RemoveAll(dir)
+	_ = os.MkdirAll(dir, os.FileMode(0755))
+
+	input := inputJSON{
+		Source: fake.source(),
+		Params: paramsJSON{Message: "TestRealMainOverridePolicies", PollingPeriod: 1},
+	}
+	byteInput, _ := json.Marshal(input)
+	output, err := realMain([]string{"out", dir}, bytes.NewReader(byteInput))
+	if err != nil {
+		t.Fatalf("out failed: %s", err)
+	}
+
+	var outResult struct{ Version version }
+	_ = json.Unmarshal(output, &outResult)
+	input.Version = outResult.Version
+	input.Params = paramsJSON{
+		Confirm:               true,
+		OverridePolicies:      true,
+		OverrideJustification: "it's fine",
+		PollingPeriod:         1,
+	}
+	byteInput, _ = json.Marshal(input)
+	_, err = realMain([]string{"in", dir}, bytes.NewReader(byteInput))
+
+	if err != nil {
+		t.Errorf("in with override_policies failed: %s", err)
+	}
+	if status := fake.runs[0].policyChecks[0].Status; status != tfe.PolicyOverridden {
+		t.Errorf("policy check finished as %s, expected overridden", status)
+	}
+	if status := fake.runs[0].run.Status; status != tfe.RunApplied {
+		t.Errorf("overridden run finished as %s, expected applied", status)
+	}
+}
+
+func TestRealMainWaitForPlanned(t *testing.T) {
+	fake := newFakeTFE(t)
+	dir := path.Join("test_output", "test_main_planned")
+	_ = os.RemoveAll(dir)
+	_ = os.MkdirAll(dir, os.FileMode(0755))
+	run := fake.addRun("TestRealMainWaitForPlanned", tfe.RunPlanning, tfe.RunPlanned)
+
+	input := inputJSON{
+		Source:  fake.source(),
+		Params:  paramsJSON{WaitFor: waitForPlanned, PollingPeriod: 1},
+		Version: version{Ref: run.ID},
+	}
+	byteInput, _ := json.Marshal(input)
+	_, err := realMain([]string{"in", dir}, bytes.NewReader(byteInput))
+
+	if err != nil {
+		t.Errorf("in with wait_for planned failed: %s", err)
+	}
+	validateFileContents(t, path.Join(dir, "plan.log"), "Plan: 1 to add, 0 to change, 0 to destroy.")
+	if status := fake.runs[0].run.Status; status != tfe.RunPlanned {
+		t.Errorf("run finished as %s, expected to wait at planned", status)
+	}
 }
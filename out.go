@@ -1,75 +1,95 @@
 package concourse_tfe_resource
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	tfe "github.com/hashicorp/go-tfe"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
-func out(input inputJSON) ([]byte, error) {
-	if err := pushVars(input); err != nil {
+func (r *Resource) out(input inputJSON) ([]byte, error) {
+	switch input.Params.Action {
+	case actionDiscard:
+		return r.discard(input)
+	case actionApply:
+		return r.apply(input)
+	}
+	if err := r.pushVars(input); err != nil {
 		return nil, err
 	}
+	if input.Params.CancelPending {
+		if err := r.cancelPendingRuns(input); err != nil {
+			return nil, err
+		}
+	}
 
 	rco := tfe.RunCreateOptions{
-		Workspace: workspace,
+		Workspace: r.Workspace,
 		Message:   &input.Params.Message,
 	}
 
-	run, err := client.Runs.Create(context.Background(), rco)
+	run, err := r.Client.Runs.Create(r.Context, rco)
 	if err != nil {
 		return nil, formatError(err, "creating run")
 	}
+	v, err := r.readVersion(input, run)
+	if err != nil {
+		return nil, err
+	}
 	result := outOutputJSON{
-		Version:  version{Ref: run.ID},
+		Version:  v,
 		Metadata: runMetadata(input, run),
 	}
 	return json.Marshal(result)
 }
 
-func pushVars(input inputJSON) error {
-	list, err := getVariableList()
+func (r *Resource) pushVars(input inputJSON) error {
+	list, err := r.getVariableList()
 	if err != nil {
 		return err
 	}
+
+	values := make(map[string]string)
 	for k, v := range input.Params.Vars {
-		if err := pushVar(list, k, v); err != nil {
+		if values[k], err = r.getValue(v, k); err != nil {
 			return err
 		}
 	}
+	if err := r.validateVars(input, list, values); err != nil {
+		return err
+	}
 
-	return nil
-}
-
-func pushVar(list tfe.VariableList, name string, v variableJSON) error {
-	var variable *tfe.Variable
-
-	// see if the variable exists
-	for _, k := range list.Items {
-		if name == k.Key {
-			variable = k
-			break
+	for k, v := range input.Params.Vars {
+		if err := r.pushVar(list, k, v, values[k]); err != nil {
+			return err
 		}
 	}
 
-	value, err := getValue(v, name)
+	return nil
+}
 
-	if err != nil {
-		return err
+func (r *Resource) pushVar(list tfe.VariableList, name string, v variableJSON, value string) error {
+	variable := findVariable(list, name)
+	if (v.Sensitive != nil && *v.Sensitive) || (v.Sensitive == nil && variable != nil && variable.Sensitive) {
+		r.redact(value)
 	}
-
 	if variable != nil {
+		if variable.Sensitive && v.Sensitive != nil && !*v.Sensitive && !v.AllowUnsensitive {
+			return fmt.Errorf("error updating variable \"%s\": refusing to make a sensitive variable "+
+				"non-sensitive without allow_unsensitive", name)
+		}
 		update := tfe.VariableUpdateOptions{
 			Key:         &name,
 			Value:       &value,
-			HCL:         &v.Hcl,
-			Sensitive:   &v.Sensitive,
-			Description: &v.Description,
+			HCL:         v.Hcl,
+			Sensitive:   v.Sensitive,
+			Description: v.Description,
 		}
-		_, err := client.Variables.Update(context.Background(), workspace.ID, variable.ID, update)
+		_, err := r.Client.Variables.Update(r.Context, r.Workspace.ID, variable.ID, update)
 		if err != nil {
 			return formatError(err, "updating variable \""+name+"\"")
 		}
@@ -77,12 +97,12 @@ func pushVar(list tfe.VariableList, name string, v variableJSON) error {
 		create := tfe.VariableCreateOptions{
 			Key:         &name,
 			Value:       &value,
-			HCL:         &v.Hcl,
-			Sensitive:   &v.Sensitive,
-			Description: &v.Description,
+			HCL:         v.Hcl,
+			Sensitive:   v.Sensitive,
+			Description: v.Description,
 			Category:    &v.Category,
 		}
-		_, err := client.Variables.Create(context.Background(), workspace.ID, create)
+		_, err := r.Client.Variables.Create(r.Context, r.Workspace.ID, create)
 		if err != nil {
 			return formatError(err, "creating variable \""+name+"\"")
 		}
@@ -90,12 +110,26 @@ func pushVar(list tfe.VariableList, name string, v variableJSON) error {
 	return nil
 }
 
-func getValue(v variableJSON, name string) (string, error) {
+func findVariable(list tfe.VariableList, name string) *tfe.Variable {
+	for _, k := range list.Items {
+		if name == k.Key {
+			return k
+		}
+	}
+	return nil
+}
+
+func (r *Resource) getValue(v variableJSON, name string) (string, error) {
 	var value string
-	if v.Value != "" {
+	if v.Value != "" && v.Interpolate {
+		var err error
+		if value, err = r.interpolateValue(v.Value); err != nil {
+			return "", formatError(err, "interpolating value for variable \""+name+"\"")
+		}
+	} else if v.Value != "" {
 		value = v.Value
 	} else if v.File != "" {
-		fileName := path.Join(workingDirectory, v.File)
+		fileName := path.Join(r.WorkingDirectory, v.File)
 		f, err := os.Open(fileName)
 		if err != nil {
 			return "", formatError(err, "getting value for variable \""+name+"\"")
@@ -111,3 +145,85 @@ func getValue(v variableJSON, name string) (string, error) {
 	}
 	return value, nil
 }
+
+var lookupPattern = regexp.MustCompile(`\$\{(file|json):([^}]+)}`)
+
+// interpolateValue substitutes the same build variables as run messages, plus ${file:path} and
+// ${json:path#.field} lookups into files in the working directory
+func (r *Resource) interpolateValue(value string) (string, error) {
+	var (
+		result strings.Builder
+		last   int
+	)
+	for _, m := range lookupPattern.FindAllStringSubmatchIndex(value, -1) {
+		literal, err := parseMessage(value[last:m[0]])
+		if err != nil {
+			return "", err
+		}
+		lookup, err := r.lookupValue(value[m[2]:m[3]], value[m[4]:m[5]])
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(literal)
+		result.WriteString(lookup)
+		last = m[1]
+	}
+	literal, err := parseMessage(value[last:])
+	if err != nil {
+		return "", err
+	}
+	result.WriteString(literal)
+	return result.String(), nil
+}
+
+func (r *Resource) lookupValue(kind string, ref string) (string, error) {
+	fileName, field := ref, ""
+	if kind == "json" {
+		if i := strings.Index(ref, "#"); i >= 0 {
+			fileName, field = ref[:i], ref[i+1:]
+		}
+	}
+
+	contents, err := os.ReadFile(path.Join(r.WorkingDirectory, fileName))
+	if err != nil {
+		return "", formatError(err, "reading "+fileName)
+	}
+	if kind == "file" {
+		// files written by other resources and tasks almost always end with a newline nobody wants in the value
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+
+	doc, err := decodeOutput(contents)
+	if err != nil {
+		return "", formatError(err, "parsing "+fileName)
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(field, "."), ".") {
+		if key == "" {
+			continue
+		}
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = node[key]; !ok {
+				return "", fmt.Errorf("error looking up \"%s\" in %s: no such field", field, fileName)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("error looking up \"%s\" in %s: invalid index \"%s\"", field, fileName, key)
+			}
+			doc = node[i]
+		default:
+			return "", fmt.Errorf("error looking up \"%s\" in %s: no such field", field, fileName)
+		}
+	}
+
+	if str, ok := doc.(string); ok {
+		return str, nil
+	}
+	byteVal, err := json.Marshal(doc)
+	if err != nil {
+		return "", formatError(err, "marshalling "+ref)
+	}
+	return string(byteVal), nil
+}
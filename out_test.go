@@ -11,27 +11,29 @@ import (
 )
 
 func TestOutNoVars(t *testing.T) {
-	run := setup(t)
+	r, run := setup(t)
 	input := inputJSON{
 		Source: sourceJSON{
-			Workspace: workspace.ID,
+			Workspace: r.Workspace.ID,
 		},
 	}
 
-	runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
-	variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&tfe.VariableList{}, nil)
-	variables.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+	r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+	r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&tfe.VariableList{}, nil)
+	r.variables.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
 
-	out(input)
+	r.out(input)
 }
 
 func TestOutVars(t *testing.T) {
-	run := setup(t)
+	r, run := setup(t)
+	wd, _ := os.Getwd()
+	r.WorkingDirectory = path.Join(wd, "test_output", "test_out_vars")
 	vars := make(map[string]variableJSON)
 
 	vars["new_var"] = variableJSON{
 		Value:       "baz",
-		Description: "a description",
+		Description: tfe.String("a description"),
 	}
 	vars["existing_var"] = variableJSON{
 		Value: "moo",
@@ -39,7 +41,7 @@ func TestOutVars(t *testing.T) {
 
 	vars["ENV_VAR"] = variableJSON{
 		Value:       "an_environment",
-		Description: "Env var",
+		Description: tfe.String("Env var"),
 		Category:    tfe.CategoryEnv,
 	}
 	vars["NEW_ENV_VAR"] = variableJSON{
@@ -49,7 +51,7 @@ func TestOutVars(t *testing.T) {
 
 	input := inputJSON{
 		Source: sourceJSON{
-			Workspace: workspace.ID,
+			Workspace: r.Workspace.ID,
 		},
 		Params: paramsJSON{
 			Vars: vars,
@@ -60,18 +62,18 @@ func TestOutVars(t *testing.T) {
 	v2 := tfe.Variable{Key: "ENV_VAR", ID: "var-234", Category: tfe.CategoryEnv}
 	vlist := tfe.VariableList{Items: []*tfe.Variable{&v1, &v2}}
 
-	runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
-	variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-	variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(2).DoAndReturn(
+	r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+	r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+	r.variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(2).DoAndReturn(
 		func(_ interface{}, _ string, v tfe.VariableCreateOptions) (*tfe.Variable, error) {
 			if *v.Key == "NEW_ENV_VAR" && !strings.Contains(*v.Value, "coverage.html") {
 				t.Error("file value not set properly")
 			}
 			return &tfe.Variable{ID: "var-345"}, nil
 		})
-	variables.EXPECT().Update(gomock.Any(), "foo", gomock.Any(), gomock.Any()).Times(2).Return(&tfe.Variable{ID: "var-345"}, nil)
+	r.variables.EXPECT().Update(gomock.Any(), "foo", gomock.Any(), gomock.Any()).Times(2).Return(&tfe.Variable{ID: "var-345"}, nil)
 
-	out(input)
+	r.out(input)
 }
 
 func TestOutErrorConditions(t *testing.T) {
@@ -79,7 +81,7 @@ func TestOutErrorConditions(t *testing.T) {
 
 	input := inputJSON{
 		Source: sourceJSON{
-			Workspace: workspace.ID,
+			Workspace: "foo",
 		},
 		Params: paramsJSON{
 			Vars: vars,
@@ -91,31 +93,31 @@ func TestOutErrorConditions(t *testing.T) {
 	vlist := tfe.VariableList{Items: []*tfe.Variable{&v1, &v2}}
 
 	t.Run("list variables fails", func(t *testing.T) {
-		_ = setup(t)
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, errors.New("NO"))
+		r, _ := setup(t)
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, errors.New("NO"))
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error retrieving workspace variables: NO") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 	t.Run("variable without a value", func(t *testing.T) {
-		_ = setup(t)
+		r, _ := setup(t)
 		badVars := make(map[string]variableJSON)
 		badVars["doom"] = variableJSON{
-			Description: "this doesn't have a value",
+			Description: tfe.String("this doesn't have a value"),
 		}
 		input.Params.Vars = badVars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error finding value for variable \"doom\": no value or filename provided") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 	t.Run("variable with a non-existent file value", func(t *testing.T) {
-		_ = setup(t)
+		r, _ := setup(t)
 		badVars := make(map[string]variableJSON)
 		badVars["gloom"] = variableJSON{
 			File:     "/no/way/this/exists",
@@ -123,17 +125,17 @@ func TestOutErrorConditions(t *testing.T) {
 		}
 		input.Params.Vars = badVars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error getting value for variable \"gloom\":") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 	t.Run("variable with a usable file value", func(t *testing.T) {
-		run := setup(t)
-		workingDirectory, _ = os.Getwd()
-		fileName := path.Join(workingDirectory, "readable-test-file")
+		r, run := setup(t)
+		r.WorkingDirectory, _ = os.Getwd()
+		fileName := path.Join(r.WorkingDirectory, "readable-test-file")
 		f, _ := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, os.FileMode(0755))
 		_, _ = f.Write([]byte("athinger"))
 		_ = f.Close()
@@ -143,83 +145,199 @@ func TestOutErrorConditions(t *testing.T) {
 		}
 		input.Params.Vars = badVars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-		variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"}, nil)
-		runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"}, nil)
+		r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if result == nil || err != nil {
 			t.Errorf("unexpected failure:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
+	t.Run("variable with invalid hcl", func(t *testing.T) {
+		r, _ := setup(t)
+		badVars := make(map[string]variableJSON)
+		badVars["new_var"] = variableJSON{
+			Value: "baz",
+		}
+		badVars["hcl_var"] = variableJSON{
+			Value: "[\"unterminated\"",
+			Hcl:   tfe.Bool(true),
+		}
+		input.Params.Vars = badVars
+
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		result, err := r.out(input)
+		if didntErrorWithSubstr(err, "error validating variable \"hcl_var\": hcl_var:1,") {
+			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
+		}
+	})
 	t.Run("creating workspace variable fails", func(t *testing.T) {
-		_ = setup(t)
+		r, _ := setup(t)
 		vars := make(map[string]variableJSON)
 		vars["new_var"] = variableJSON{
 			Value:       "baz",
-			Description: "a description",
+			Description: tfe.String("a description"),
 		}
 		input.Params.Vars = vars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-		variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"},
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"},
 			errors.New("NO"))
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error creating variable \"new_var\": NO") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 	t.Run("creating workspace environment variable fails", func(t *testing.T) {
-		_ = setup(t)
+		r, _ := setup(t)
 		envVars := make(map[string]variableJSON)
 		envVars["NEW_ENV_VAR"] = variableJSON{
 			Value:       "baz",
-			Description: "a description",
+			Description: tfe.String("a description"),
 			Category:    tfe.CategoryEnv,
 		}
 		input.Params.Vars = envVars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-		variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"},
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Create(gomock.Any(), "foo", gomock.Any()).Times(1).Return(&tfe.Variable{ID: "var-345"},
 			errors.New("NO"))
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error creating variable \"NEW_ENV_VAR\": NO") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 	t.Run("updating workspace variable fails", func(t *testing.T) {
-		_ = setup(t)
+		r, _ := setup(t)
 		vars := make(map[string]variableJSON)
 		vars["existing_var"] = variableJSON{
 			Value:       "baz",
-			Description: "a description",
+			Description: tfe.String("a description"),
 		}
 		input.Params.Vars = vars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-		variables.EXPECT().Update(gomock.Any(), "foo", gomock.Any(), gomock.Any()).Times(1).
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Update(gomock.Any(), "foo", gomock.Any(), gomock.Any()).Times(1).
 			Return(&tfe.Variable{ID: "var-345"},
 				errors.New("NO"))
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error updating variable \"existing_var\": NO") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
+	t.Run("updating leaves omitted fields alone", func(t *testing.T) {
+		r, run := setup(t)
+		vars := make(map[string]variableJSON)
+		vars["existing_var"] = variableJSON{
+			Value: "baz",
+		}
+		input.Params.Vars = vars
+
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.variables.EXPECT().Update(gomock.Any(), "foo", "var-123", gomock.Any()).Times(1).DoAndReturn(
+			func(_ interface{}, _ string, _ string, v tfe.VariableUpdateOptions) (*tfe.Variable, error) {
+				if v.Description != nil || v.HCL != nil || v.Sensitive != nil {
+					t.Errorf("omitted fields were sent: %+v", v)
+				}
+				return &tfe.Variable{ID: "var-123"}, nil
+			})
+		r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+
+		if _, err := r.out(input); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("making a sensitive variable non-sensitive", func(t *testing.T) {
+		r, run := setup(t)
+		secret := tfe.Variable{Key: "secret_var", ID: "var-456", Sensitive: true}
+		sensitiveList := tfe.VariableList{Items: []*tfe.Variable{&secret}}
+		vars := make(map[string]variableJSON)
+		vars["secret_var"] = variableJSON{
+			Value:     "baz",
+			Sensitive: tfe.Bool(false),
+		}
+		input.Params.Vars = vars
+
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&sensitiveList, nil)
+		result, err := r.out(input)
+		if didntErrorWithSubstr(err, "refusing to make a sensitive variable non-sensitive") {
+			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
+		}
+
+		vars["secret_var"] = variableJSON{
+			Value:            "baz",
+			Sensitive:        tfe.Bool(false),
+			AllowUnsensitive: true,
+		}
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&sensitiveList, nil)
+		r.variables.EXPECT().Update(gomock.Any(), "foo", "var-456", gomock.Any()).Return(&secret, nil)
+		r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+		if _, err := r.out(input); err != nil {
+			t.Errorf("unexpected error with allow_unsensitive: %s", err)
+		}
+	})
 	t.Run("creating run fails", func(t *testing.T) {
-		run := setup(t)
+		r, run := setup(t)
 		vars := make(map[string]variableJSON)
 		input.Params.Vars = vars
 
-		variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
-		runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run,
+		r.variables.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&vlist, nil)
+		r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run,
 			errors.New("NO"))
 
-		result, err := out(input)
+		result, err := r.out(input)
 		if didntErrorWithSubstr(err, "error creating run: NO") {
 			t.Errorf("unexpected:\n\tresult = \"%s\"\n\terr = \"%s\"", result, err)
 		}
 	})
 }
+
+func TestInterpolateValue(t *testing.T) {
+	wd, _ := os.Getwd()
+	r := &Resource{WorkingDirectory: path.Join(wd, "test_output", "test_interpolate_value")}
+	_ = os.MkdirAll(path.Join(r.WorkingDirectory, "image"), os.FileMode(0755))
+	_ = os.WriteFile(path.Join(r.WorkingDirectory, "image", "tag"), []byte("1.2.3\n"), os.FileMode(0644))
+	_ = os.WriteFile(path.Join(r.WorkingDirectory, "build.json"),
+		[]byte(`{"image":{"digest":"sha256:abc","ports":[80,443],"build":12345678901234567890}}`), os.FileMode(0644))
+	t.Setenv("BUILD_PIPELINE_NAME", "Pipeline")
+
+	tests := map[string]string{
+		"no substitutions":                  "no substitutions",
+		"${pipeline}:${file:image/tag}":     "Pipeline:1.2.3",
+		"${json:build.json#.image.digest}":  "sha256:abc",
+		"${json:build.json#.image.ports.1}": "443",
+		"${json:build.json#.image.ports}":   "[80,443]",
+		"${json:build.json#.image.build}":   "12345678901234567890",
+	}
+	for value, expected := range tests {
+		if output, err := r.interpolateValue(value); output != expected || err != nil {
+			t.Errorf("unexpected result interpolating %s: %s / %s", value, output, err)
+		}
+	}
+
+	failures := map[string]string{
+		"${file:missing}":                   "error reading missing",
+		"${json:image/tag#.foo}":            "error parsing image/tag",
+		"${json:build.json#.image.missing}": "no such field",
+		"${json:build.json#.image.ports.2}": "invalid index \"2\"",
+		"${file:image/tag}${pipeline":       "",
+	}
+	for value, expected := range failures {
+		if output, err := r.interpolateValue(value); didntErrorWithSubstr(err, expected) {
+			t.Errorf("expected error interpolating %s, got: %s / %s", value, output, err)
+		}
+	}
+
+	if value, err := r.getValue(variableJSON{Value: "${file:image/tag}"}, "plain"); value != "${file:image/tag}" {
+		t.Errorf("value was interpolated without interpolate set: %s / %s", value, err)
+	}
+	_, err := r.getValue(variableJSON{Value: "${file:missing}", Interpolate: true}, "broken")
+	if didntErrorWithSubstr(err, "error interpolating value for variable \"broken\"") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,248 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+const (
+	formatYAML   = "yaml"
+	formatTfvars = "tfvars"
+	formatEnv    = "env"
+	formatRaw    = "raw"
+)
+
+var outputFormats = []string{formatYAML, formatTfvars, formatEnv, formatRaw}
+
+func validOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOutputs applies the include and exclude patterns to the original output names, then renames what's left
+func filterOutputs(outputs []*tfe.StateVersionOutput, filter outputFilterJSON) ([]*tfe.StateVersionOutput, error) {
+	var (
+		filtered []*tfe.StateVersionOutput
+		names    = make(map[string]string)
+	)
+	for _, output := range outputs {
+		if len(filter.Include) > 0 && !matchesAny(output.Name, filter.Include) {
+			continue
+		}
+		if matchesAny(output.Name, filter.Exclude) {
+			continue
+		}
+
+		renamed := *output
+		if name, ok := filter.Rename[output.Name]; ok {
+			renamed.Name = name
+		}
+		if original, ok := names[renamed.Name]; ok {
+			return nil, fmt.Errorf("error renaming outputs: \"%s\" and \"%s\" would both be written as \"%s\"",
+				original, output.Name, renamed.Name)
+		}
+		names[renamed.Name] = output.Name
+		filtered = append(filtered, &renamed)
+	}
+	return filtered, nil
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOutputFormats writes the additional output files requested in output_formats. outputs holds the same values
+// as outputs.json, with hidden sensitive outputs set to nil.
+func (r *Resource) writeOutputFormats(formats []string, outputs map[string]json.RawMessage) error {
+	for _, format := range formats {
+		var err error
+		switch format {
+		case formatYAML:
+			err = r.writeYAMLOutputs(outputs)
+		case formatTfvars:
+			err = r.writeTfvarsOutputs(outputs)
+		case formatEnv:
+			err = r.writeEnvOutputs(outputs)
+		case formatRaw:
+			err = r.writeRawOutputs(outputs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Resource) writeYAMLOutputs(outputs map[string]json.RawMessage) error {
+	jsonOutput, err := json.Marshal(outputs)
+	if err != nil {
+		return formatError(err, "marshaling outputs.yml")
+	}
+	yamlOutput, err := yaml.JSONToYAML(jsonOutput)
+	if err != nil {
+		return formatError(err, "converting outputs.yml")
+	}
+	return writeAndClose(path.Join(r.WorkingDirectory, "outputs.yml"), yamlOutput)
+}
+
+// writeTfvarsOutputs leaves out hidden sensitive outputs, since a null would override the variable's default
+func (r *Resource) writeTfvarsOutputs(outputs map[string]json.RawMessage) error {
+	tfvars := make(map[string]json.RawMessage)
+	for k, v := range outputs {
+		if v != nil {
+			tfvars[k] = v
+		}
+	}
+	return r.writeJSONFile(tfvars, "terraform.tfvars.json")
+}
+
+// writeEnvOutputs writes a file that can be sourced by a shell, with maps and lists flattened into one variable per
+// scalar value (e.g. tags_team and ports_0)
+func (r *Resource) writeEnvOutputs(outputs map[string]json.RawMessage) error {
+	values := make(map[string]string)
+	// the output (and field) each variable was flattened from, to catch two of them getting the same name
+	sources := make(map[string]string)
+	for k, v := range outputs {
+		var value interface{}
+		if v != nil {
+			var err error
+			if value, err = decodeOutput(v); err != nil {
+				return formatError(err, "decoding output \""+k+"\"")
+			}
+		}
+		if err := flattenOutput(envName(k), k, value, values, sources); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var env bytes.Buffer
+	for _, k := range keys {
+		env.WriteString(fmt.Sprintf("%s=%s\n", k, shellQuote(values[k])))
+	}
+	return writeAndClose(path.Join(r.WorkingDirectory, "outputs.env"), env.Bytes())
+}
+
+// writeRawOutputs writes unquoted values for string, number and bool outputs so tasks can read them without jq
+func (r *Resource) writeRawOutputs(outputs map[string]json.RawMessage) error {
+	rawDir := path.Join(r.WorkingDirectory, "raw_outputs")
+	if err := os.MkdirAll(rawDir, os.FileMode(0777)); err != nil {
+		return formatError(err, "creating raw output directory")
+	}
+	for k, v := range outputs {
+		var raw string
+		if v != nil {
+			value, err := decodeOutput(v)
+			if err != nil {
+				return formatError(err, "decoding output \""+k+"\"")
+			}
+			var ok bool
+			if raw, ok = scalarString(value); !ok {
+				continue
+			}
+		}
+		if err := writeAndClose(path.Join(rawDir, k), []byte(raw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeOutput(raw json.RawMessage) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// keep numbers exactly as terraform rendered them
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	// like json.Unmarshal, reject anything after the value
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return value, nil
+}
+
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	case nil:
+		return "", true
+	}
+	return "", false
+}
+
+func flattenOutput(prefix string, source string, value interface{}, values map[string]string,
+	sources map[string]string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if err := flattenOutput(prefix+"_"+envName(k), source+"."+k, child, values, sources); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := flattenOutput(fmt.Sprintf("%s_%d", prefix, i), fmt.Sprintf("%s.%d", source, i), child, values,
+				sources); err != nil {
+				return err
+			}
+		}
+	default:
+		if existing, ok := sources[prefix]; ok {
+			// sort them so the error doesn't depend on map order
+			first, second := existing, source
+			if second < first {
+				first, second = second, first
+			}
+			return fmt.Errorf("error writing env outputs: \"%s\" and \"%s\" would both be written as %s", first,
+				second, prefix)
+		}
+		sources[prefix] = source
+		values[prefix], _ = scalarString(v)
+	}
+	return nil
+}
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func envName(name string) string {
+	name = invalidEnvChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,105 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/go-tfe"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWriteOutputFormats(t *testing.T) {
+	wd, _ := os.Getwd()
+	r := &Resource{WorkingDirectory: path.Join(wd, "test_output", "test_output_formats")}
+	_ = os.RemoveAll(r.WorkingDirectory)
+	_ = os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+
+	outputs := map[string]json.RawMessage{
+		"name":   json.RawMessage(`"it's here"`),
+		"count":  json.RawMessage(`3.50`),
+		"tags":   json.RawMessage(`{"team":"infra","cost-centre":"42"}`),
+		"ports":  json.RawMessage(`[80,443]`),
+		"secret": nil,
+	}
+
+	if err := r.writeOutputFormats(outputFormats, outputs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	validateFileContents(t, path.Join(r.WorkingDirectory, "outputs.yml"),
+		"count: 3.5\nname: it's here\nports:\n- 80\n- 443\nsecret: null\ntags:\n  cost-centre: \"42\"\n  team: infra\n")
+	validateFileContents(t, path.Join(r.WorkingDirectory, "terraform.tfvars.json"),
+		`{"count":3.50,"name":"it's here","ports":[80,443],"tags":{"team":"infra","cost-centre":"42"}}`)
+	validateFileContents(t, path.Join(r.WorkingDirectory, "outputs.env"),
+		"count='3.50'\nname='it'\\''s here'\nports_0='80'\nports_1='443'\nsecret=''\n"+
+			"tags_cost_centre='42'\ntags_team='infra'\n")
+	validateFileContents(t, path.Join(r.WorkingDirectory, "raw_outputs", "name"), "it's here")
+	validateFileContents(t, path.Join(r.WorkingDirectory, "raw_outputs", "count"), "3.50")
+	validateFileContents(t, path.Join(r.WorkingDirectory, "raw_outputs", "secret"), "")
+	if _, err := os.Stat(path.Join(r.WorkingDirectory, "raw_outputs", "tags")); !os.IsNotExist(err) {
+		t.Error("raw file was written for a complex output")
+	}
+
+	outputs = map[string]json.RawMessage{
+		"tags_team": json.RawMessage(`"platform"`),
+		"tags":      json.RawMessage(`{"team":"infra"}`),
+	}
+	err := r.writeOutputFormats([]string{"env"}, outputs)
+	if err == nil || err.Error() != "error writing env outputs: \"tags.team\" and \"tags_team\" would both be "+
+		"written as tags_team" {
+		t.Errorf("expected collision error, got %s", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"simple":    "simple",
+		"with-dash": "with_dash",
+		"0start":    "_0start",
+		"":          "_",
+	}
+	for name, expected := range tests {
+		if result := envName(name); result != expected {
+			t.Errorf("envName(%s) = %s, expected %s", name, result, expected)
+		}
+	}
+}
+
+func TestFilterOutputs(t *testing.T) {
+	outputs := []*tfe.StateVersionOutput{
+		{Name: "vpc_id", Value: "vpc-123"},
+		{Name: "vpc_cidr", Value: "10.0.0.0/16"},
+		{Name: "vpc_secret", Value: "shh", Sensitive: true},
+		{Name: "db_host", Value: "db.internal"},
+	}
+
+	names := func(outputs []*tfe.StateVersionOutput) (names []string) {
+		for _, o := range outputs {
+			names = append(names, o.Name)
+		}
+		return
+	}
+
+	result, err := filterOutputs(outputs, outputFilterJSON{})
+	if err != nil || len(result) != 4 {
+		t.Errorf("empty filter changed outputs: %v / %s", names(result), err)
+	}
+
+	result, err = filterOutputs(outputs, outputFilterJSON{
+		Include: []string{"vpc_*"},
+		Exclude: []string{"*_secret"},
+		Rename:  map[string]string{"vpc_id": "id", "db_host": "host"},
+	})
+	if err != nil || strings.Join(names(result), ",") != "id,vpc_cidr" {
+		t.Errorf("unexpected filter result: %v / %s", names(result), err)
+	}
+	if outputs[0].Name != "vpc_id" {
+		t.Error("renaming modified the original output")
+	}
+
+	_, err = filterOutputs(outputs, outputFilterJSON{Rename: map[string]string{"vpc_id": "db_host"}})
+	if didntErrorWithSubstr(err, "\"vpc_id\" and \"db_host\" would both be written as \"db_host\"") {
+		t.Errorf("expected rename conflict, got %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+package concourse_tfe_resource
+
+import (
+	"errors"
+	"github.com/drone/envsubst"
+	tfe "github.com/hashicorp/go-tfe"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// runs in these states haven't started applying, and hold up the workspace's queue until they're canceled or discarded
+var pendingStatuses = []tfe.RunStatus{
+	tfe.RunPending,
+	tfe.RunFetching,
+	tfe.RunFetchingCompleted,
+	tfe.RunPrePlanRunning,
+	tfe.RunPrePlanCompleted,
+	tfe.RunQueuing,
+	tfe.RunPlanQueued,
+	tfe.RunPlanning,
+	tfe.RunPlanned,
+	tfe.RunCostEstimating,
+	tfe.RunCostEstimated,
+	tfe.RunPolicyChecking,
+	tfe.RunPolicyOverride,
+	tfe.RunPolicyChecked,
+	tfe.RunPostPlanRunning,
+	tfe.RunPostPlanCompleted,
+	tfe.RunPostPlanAwaitingDecision,
+}
+
+// stands in for the build-specific message variables while building a pattern
+const buildPlaceholder = "\x00"
+
+// messagePattern matches the messages the given template produces in any build of the current job. Templates with no
+// text outside the build-specific variables are refused, since their pattern would match almost any run.
+func messagePattern(template string) (*regexp.Regexp, error) {
+	message, err := envsubst.Eval(template, func(varName string) string {
+		if varName == "id" || varName == "number" {
+			return buildPlaceholder
+		}
+		return messageVariable(varName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if strings.IndexFunc(message, func(c rune) bool { return unicode.IsLetter(c) || unicode.IsDigit(c) }) < 0 {
+		return nil, errors.New("message has no text to identify the job's runs, such as ${pipeline} and ${job}")
+	}
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(message), buildPlaceholder, ".+")
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// cancelPendingRuns discards or cancels runs which haven't started applying and were queued by earlier builds of this
+// job, recognised by their messages matching the message template
+func (r *Resource) cancelPendingRuns(input inputJSON) error {
+	pattern, err := messagePattern(input.Params.MessageTemplate)
+	if err != nil {
+		return formatError(err, "parsing message template")
+	}
+	statuses := make([]string, len(pendingStatuses))
+	for i, s := range pendingStatuses {
+		statuses[i] = string(s)
+	}
+	rlo := tfe.RunListOptions{
+		ListOptions: tfe.ListOptions{PageSize: 100},
+		Status:      strings.Join(statuses, ","),
+	}
+
+	// acting on a run takes it out of the filtered list and moves later pages up, so every page is listed first
+	var superseded []*tfe.Run
+	for {
+		runs, err := r.Client.Runs.List(r.Context, r.Workspace.ID, &rlo)
+		if err != nil {
+			return formatError(err, "listing pending runs")
+		}
+		for _, run := range runs.Items {
+			if pattern.MatchString(run.Message) && run.Actions != nil {
+				superseded = append(superseded, run)
+			}
+		}
+		if runs.Pagination == nil || runs.Pagination.NextPage == 0 {
+			break
+		}
+		rlo.PageNumber = runs.Pagination.NextPage
+	}
+
+	comment := "Superseded by a newer run: " + input.Params.Message
+	for _, run := range superseded {
+		if run.Actions.IsDiscardable {
+			err = r.Client.Runs.Discard(r.Context, run.ID, tfe.RunDiscardOptions{Comment: &comment})
+			if err != nil {
+				return formatError(err, "discarding run "+run.ID)
+			}
+			r.Logger.Printf("Discarded superseded run %s (status = %s)", run.ID, run.Status)
+		} else if run.Actions.IsCancelable {
+			err = r.Client.Runs.Cancel(r.Context, run.ID, tfe.RunCancelOptions{Comment: &comment})
+			if err != nil {
+				return formatError(err, "canceling run "+run.ID)
+			}
+			r.Logger.Printf("Canceled superseded run %s (status = %s)", run.ID, run.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"strings"
+	"testing"
+)
+
+func TestMessagePattern(t *testing.T) {
+	t.Setenv("BUILD_PIPELINE_NAME", "infra")
+	t.Setenv("BUILD_JOB_NAME", "plan")
+	pattern, err := messagePattern("Queued by ${pipeline}/${job} (${number}) [${id}]")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for message, expected := range map[string]bool{
+		"Queued by infra/plan (14) [1234]":   true,
+		"Queued by infra/plan (14.1) [1235]": true,
+		"Queued by infra/apply (14) [1234]":  false,
+		"Queued by infra/plan () []":         false,
+		"Queued by other/plan (14) [1234]":   false,
+		"Queued manually":                    false,
+	} {
+		if pattern.MatchString(message) != expected {
+			t.Errorf("expected match of \"%s\" to be %v", message, expected)
+		}
+	}
+
+	if _, err := messagePattern("${number"); err == nil {
+		t.Error("accepted an invalid template")
+	}
+	for _, template := range []string{"${number}", "(${number}) [${id}]"} {
+		if _, err := messagePattern(template); didntErrorWithSubstr(err, "no text to identify the job's runs") {
+			t.Errorf("accepted template \"%s\" which matches any run: %s", template, err)
+		}
+	}
+}
+
+func TestCancelPendingRuns(t *testing.T) {
+	input := inputJSON{Params: paramsJSON{
+		CancelPending:   true,
+		Message:         "Queued by job (3)",
+		MessageTemplate: "Queued by job (${number})",
+	}}
+
+	t.Run("template matching any run", func(t *testing.T) {
+		r, _ := setup(t)
+		r.runs.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		anything := input
+		anything.Params.MessageTemplate = "${number}"
+		if err := r.cancelPendingRuns(anything); didntErrorWithSubstr(err, "error parsing message template") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("cancels and discards matching runs", func(t *testing.T) {
+		r, _ := setup(t)
+		comment := tfe.String("Superseded by a newer run: Queued by job (3)")
+		first := tfe.RunList{
+			Items: []*tfe.Run{
+				{ID: "run-1", Message: "Queued by job (1)", Status: tfe.RunPlanned,
+					Actions: &tfe.RunActions{IsDiscardable: true}},
+				{ID: "run-2", Message: "Queued manually", Status: tfe.RunPlanned,
+					Actions: &tfe.RunActions{IsDiscardable: true}},
+			},
+			Pagination: &tfe.Pagination{NextPage: 2},
+		}
+		second := tfe.RunList{Items: []*tfe.Run{
+			{ID: "run-3", Message: "Queued by job (2)", Status: tfe.RunPlanning,
+				Actions: &tfe.RunActions{IsCancelable: true}},
+			{ID: "run-4", Message: "Queued by job (2.1)", Status: tfe.RunPlanning, Actions: &tfe.RunActions{}},
+		}}
+		gomock.InOrder(
+			r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).DoAndReturn(
+				func(_ interface{}, _ string, rlo *tfe.RunListOptions) (*tfe.RunList, error) {
+					if !strings.Contains(rlo.Status, "pending") || strings.Contains(rlo.Status, "applying") ||
+						strings.Contains(rlo.Status, "policy_soft_failed") {
+						t.Errorf("unexpected status filter %s", rlo.Status)
+					}
+					return &first, nil
+				}),
+			r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).DoAndReturn(
+				func(_ interface{}, _ string, rlo *tfe.RunListOptions) (*tfe.RunList, error) {
+					if rlo.PageNumber != 2 {
+						t.Errorf("expected page 2, got %d", rlo.PageNumber)
+					}
+					return &second, nil
+				}),
+			// nothing is discarded or canceled until every page is listed, so no pages are skipped
+			r.runs.EXPECT().Discard(gomock.Any(), "run-1", tfe.RunDiscardOptions{Comment: comment}).Return(nil),
+			r.runs.EXPECT().Cancel(gomock.Any(), "run-3", tfe.RunCancelOptions{Comment: comment}).Return(nil),
+		)
+
+		if err := r.cancelPendingRuns(input); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("before creating a run", func(t *testing.T) {
+		r, run := setup(t)
+		r.variables.EXPECT().List(gomock.Any(), gomock.Any(), gomock.Any()).Return(&tfe.VariableList{}, nil)
+		gomock.InOrder(
+			r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&tfe.RunList{}, nil),
+			r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil),
+		)
+		if _, err := r.out(input); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error listing runs", func(t *testing.T) {
+		r, _ := setup(t)
+		r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+		if err := r.cancelPendingRuns(input); didntErrorWithSubstr(err, "error listing pending runs: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error discarding run", func(t *testing.T) {
+		r, _ := setup(t)
+		r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&tfe.RunList{Items: []*tfe.Run{
+			{ID: "run-1", Message: "Queued by job (1)", Actions: &tfe.RunActions{IsDiscardable: true}},
+		}}, nil)
+		r.runs.EXPECT().Discard(gomock.Any(), "run-1", gomock.Any()).Return(fmt.Errorf("NO"))
+		if err := r.cancelPendingRuns(input); didntErrorWithSubstr(err, "error discarding run run-1: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error canceling run", func(t *testing.T) {
+		r, _ := setup(t)
+		r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&tfe.RunList{Items: []*tfe.Run{
+			{ID: "run-1", Message: "Queued by job (1)", Actions: &tfe.RunActions{IsCancelable: true}},
+		}}, nil)
+		r.runs.EXPECT().Cancel(gomock.Any(), "run-1", gomock.Any()).Return(fmt.Errorf("NO"))
+		if err := r.cancelPendingRuns(input); didntErrorWithSubstr(err, "error canceling run run-1: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package concourse_tfe_resource
+
+import (
+	tfe "github.com/hashicorp/go-tfe"
+	"io"
+	"path"
+)
+
+const waitForPlanned = "planned"
+
+type planSummaryJSON struct {
+	Status               string `json:"status"`
+	HasChanges           bool   `json:"has_changes"`
+	ResourceAdditions    int    `json:"resource_additions"`
+	ResourceChanges      int    `json:"resource_changes"`
+	ResourceDestructions int    `json:"resource_destructions"`
+	ResourceImports      int    `json:"resource_imports"`
+}
+
+// writePlan writes a summary of the run's plan to plan.json and its logs to plan.log, so a reviewer can see what
+// they're approving
+func (r *Resource) writePlan(run *tfe.Run) error {
+	if run.Plan == nil {
+		return nil
+	}
+	plan, err := r.Client.Plans.Read(r.Context, run.Plan.ID)
+	if err != nil {
+		return formatError(err, "reading plan")
+	}
+	summary := planSummaryJSON{
+		Status:               string(plan.Status),
+		HasChanges:           plan.HasChanges,
+		ResourceAdditions:    plan.ResourceAdditions,
+		ResourceChanges:      plan.ResourceChanges,
+		ResourceDestructions: plan.ResourceDestructions,
+		ResourceImports:      plan.ResourceImports,
+	}
+	if err := r.writeJSONFile(summary, "plan.json"); err != nil {
+		return err
+	}
+
+	logs, err := r.Client.Plans.Logs(r.Context, plan.ID)
+	if err != nil {
+		return formatError(err, "retrieving plan logs")
+	}
+	byteVal, err := io.ReadAll(logs)
+	if err != nil {
+		return formatError(err, "reading plan logs")
+	}
+	return writeAndClose(path.Join(r.WorkingDirectory, "plan.log"), byteVal)
+}
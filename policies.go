@@ -0,0 +1,223 @@
+package concourse_tfe_resource
+
+import (
+	"encoding/json"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"sort"
+	"strings"
+)
+
+const (
+	policyPassed  = "passed"
+	policyFailed  = "failed"
+	policyErrored = "errored"
+)
+
+type (
+	policyResultJSON struct {
+		Name             string `json:"name"`
+		PolicySet        string `json:"policy_set"`
+		Kind             string `json:"kind"`
+		EnforcementLevel string `json:"enforcement_level"`
+		Result           string `json:"result"`
+	}
+	// the shape of the "sentinel" attribute of a policy check result, which go-tfe leaves untyped
+	sentinelResultJSON struct {
+		Data map[string]struct {
+			CanOverride bool `json:"can-override"`
+			Policies    []struct {
+				AllowedFailure bool        `json:"allowed-failure"`
+				Error          interface{} `json:"error"`
+				Policy         string      `json:"policy"`
+				Result         bool        `json:"result"`
+			} `json:"policies"`
+		} `json:"data"`
+	}
+)
+
+// getPolicyResults collects the result of each sentinel and OPA policy evaluated for the run
+func (r *Resource) getPolicyResults(run *tfe.Run) ([]policyResultJSON, error) {
+	results := []policyResultJSON{}
+	if len(run.PolicyChecks) > 0 {
+		checks, err := r.listPolicyChecks(run.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, check := range checks {
+			sentinel, err := sentinelResults(check)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, sentinel...)
+		}
+	}
+	if len(run.TaskStages) > 0 {
+		stages, err := r.listTaskStages(run.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range stages {
+			for _, evaluation := range stage.PolicyEvaluations {
+				opa, err := r.opaResults(evaluation.ID)
+				if err != nil {
+					return nil, err
+				}
+				results = append(results, opa...)
+			}
+		}
+	}
+	return results, nil
+}
+
+func sentinelResults(check *tfe.PolicyCheck) ([]policyResultJSON, error) {
+	var (
+		results  []policyResultJSON
+		sentinel sentinelResultJSON
+	)
+	if check.Result == nil || check.Result.Sentinel == nil {
+		return results, nil
+	}
+	byteVal, err := json.Marshal(check.Result.Sentinel)
+	if err == nil {
+		err = json.Unmarshal(byteVal, &sentinel)
+	}
+	if err != nil {
+		return nil, formatError(err, "reading sentinel results")
+	}
+
+	for setName, set := range sentinel.Data {
+		for _, p := range set.Policies {
+			// sentinel only reports whether a failure is allowed or can be overridden, which is how the
+			// enforcement levels behave
+			result := policyResultJSON{
+				Name:             p.Policy[strings.LastIndex(p.Policy, "/")+1:],
+				PolicySet:        setName,
+				Kind:             "sentinel",
+				EnforcementLevel: string(tfe.EnforcementHard),
+				Result:           policyFailed,
+			}
+			if p.AllowedFailure {
+				result.EnforcementLevel = string(tfe.EnforcementAdvisory)
+			} else if set.CanOverride {
+				result.EnforcementLevel = string(tfe.EnforcementSoft)
+			}
+			if p.Error != nil {
+				result.Result = policyErrored
+			} else if p.Result {
+				result.Result = policyPassed
+			}
+			results = append(results, result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].PolicySet != results[j].PolicySet {
+			return results[i].PolicySet < results[j].PolicySet
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (r *Resource) opaResults(evaluationID string) ([]policyResultJSON, error) {
+	var results []policyResultJSON
+	options := tfe.PolicySetOutcomeListOptions{ListOptions: &tfe.ListOptions{PageNumber: 1, PageSize: 100}}
+	for {
+		outcomes, err := r.Client.PolicySetOutcomes.List(r.Context, evaluationID, &options)
+		if err != nil {
+			return nil, formatError(err, "listing policy outcomes")
+		}
+		for _, set := range outcomes.Items {
+			for _, o := range set.Outcomes {
+				results = append(results, policyResultJSON{
+					Name:             o.PolicyName,
+					PolicySet:        set.PolicySetName,
+					Kind:             "opa",
+					EnforcementLevel: string(o.EnforcementLevel),
+					Result:           o.Status,
+				})
+			}
+		}
+		if len(outcomes.Items) == 0 || outcomes.Pagination == nil || outcomes.Pagination.NextPage == 0 {
+			return results, nil
+		}
+		options.PageNumber++
+	}
+}
+
+func policyMetadata(results []policyResultJSON) []versionMetadata {
+	if len(results) == 0 {
+		return nil
+	}
+	var passed, failed, advisory int
+	for _, r := range results {
+		switch {
+		case r.Result == policyPassed:
+			passed++
+		case r.EnforcementLevel == string(tfe.EnforcementAdvisory):
+			advisory++
+		default:
+			failed++
+		}
+	}
+	return []versionMetadata{
+		{Value: fmt.Sprint(passed), Name: "policies_passed"},
+		{Value: fmt.Sprint(failed), Name: "policies_failed"},
+		{Value: fmt.Sprint(advisory), Name: "policies_advisory_failed"},
+	}
+}
+
+// overridePolicies overrides every soft-failed sentinel check and OPA task stage of a run, leaving the justification
+// as a run comment since sentinel overrides can't carry one
+func (r *Resource) overridePolicies(input inputJSON, run *tfe.Run) error {
+	// find everything that can be overridden first, so the run isn't left with a justification for nothing
+	var (
+		checks []*tfe.PolicyCheck
+		stages []*tfe.TaskStage
+	)
+	if len(run.PolicyChecks) > 0 {
+		list, err := r.listPolicyChecks(run.ID)
+		if err != nil {
+			return err
+		}
+		for _, check := range list {
+			if check.Status == tfe.PolicySoftFailed && check.Actions != nil && check.Actions.IsOverridable {
+				checks = append(checks, check)
+			}
+		}
+	}
+	if len(run.TaskStages) > 0 {
+		list, err := r.listTaskStages(run.ID)
+		if err != nil {
+			return err
+		}
+		for _, stage := range list {
+			if stage.Status == tfe.TaskStageAwaitingOverride {
+				stages = append(stages, stage)
+			}
+		}
+	}
+	if len(checks)+len(stages) == 0 {
+		return fmt.Errorf("error overriding policies: no soft-failed policies could be overridden " +
+			"(the token may not have permission to override policies)")
+	}
+
+	justification := input.Params.OverrideJustification
+	_, err := r.Client.Comments.Create(r.Context, run.ID, tfe.CommentCreateOptions{Body: justification})
+	if err != nil {
+		return formatError(err, "commenting on run")
+	}
+	for _, check := range checks {
+		if _, err := r.Client.PolicyChecks.Override(r.Context, check.ID); err != nil {
+			return formatError(err, "overriding policy check")
+		}
+	}
+	for _, stage := range stages {
+		_, err := r.Client.TaskStages.Override(r.Context, stage.ID, tfe.TaskStageOverrideOptions{Comment: &justification})
+		if err != nil {
+			return formatError(err, "overriding task stage")
+		}
+	}
+	r.Logger.Printf("Overrode %d soft-failed policy evaluation(s)", len(checks)+len(stages))
+	return nil
+}
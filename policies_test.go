@@ -0,0 +1,204 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func sentinelCheck() *tfe.PolicyCheck {
+	return &tfe.PolicyCheck{
+		ID: "polchk-1",
+		Result: &tfe.PolicyResult{
+			Sentinel: map[string]interface{}{
+				"schema-version": "1.0.0",
+				"data": map[string]interface{}{
+					"networking": map[string]interface{}{
+						"can-override": true,
+						"policies": []interface{}{
+							map[string]interface{}{"policy": "networking/no-public-ips", "result": false},
+							map[string]interface{}{"policy": "networking/tags", "result": true},
+							map[string]interface{}{"policy": "networking/naming", "result": false,
+								"allowed-failure": true},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGetPolicyResults(t *testing.T) {
+	t.Run("no policies", func(t *testing.T) {
+		r, run := setup(t)
+		results, err := r.getPolicyResults(&run)
+		if err != nil || len(results) != 0 || results == nil {
+			t.Errorf("unexpected results: %v / %s", results, err)
+		}
+		if metadata := policyMetadata(results); len(metadata) != 0 {
+			t.Errorf("expected no policy metadata, got %v", metadata)
+		}
+	})
+	t.Run("sentinel and opa policies", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(
+			&tfe.PolicyCheckList{Items: []*tfe.PolicyCheck{sentinelCheck()}}, nil)
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.TaskStageList{Items: []*tfe.TaskStage{
+			{ID: "ts-1", PolicyEvaluations: []*tfe.PolicyEvaluation{{ID: "poleval-1"}}},
+		}}, nil)
+		firstPage := &tfe.PolicySetOutcomeListOptions{ListOptions: &tfe.ListOptions{PageNumber: 1, PageSize: 100}}
+		secondPage := &tfe.PolicySetOutcomeListOptions{ListOptions: &tfe.ListOptions{PageNumber: 2, PageSize: 100}}
+		r.policyOutcomes.EXPECT().List(gomock.Any(), "poleval-1", firstPage).Return(&tfe.PolicySetOutcomeList{
+			Items: []*tfe.PolicySetOutcome{{
+				PolicySetName: "opa-set",
+				Outcomes: []tfe.Outcome{
+					{PolicyName: "deny-destroy", EnforcementLevel: tfe.EnforcementMandatory, Status: "failed"},
+				},
+			}},
+			Pagination: &tfe.Pagination{CurrentPage: 1, NextPage: 2},
+		}, nil)
+		r.policyOutcomes.EXPECT().List(gomock.Any(), "poleval-1", secondPage).Return(&tfe.PolicySetOutcomeList{
+			Items: []*tfe.PolicySetOutcome{{
+				PolicySetName: "opa-set",
+				Outcomes: []tfe.Outcome{
+					{PolicyName: "require-tags", EnforcementLevel: tfe.EnforcementAdvisory, Status: "passed"},
+				},
+			}},
+			Pagination: &tfe.Pagination{CurrentPage: 2},
+		}, nil)
+
+		results, err := r.getPolicyResults(&run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []policyResultJSON{
+			{Name: "naming", PolicySet: "networking", Kind: "sentinel", EnforcementLevel: "advisory", Result: "failed"},
+			{Name: "no-public-ips", PolicySet: "networking", Kind: "sentinel", EnforcementLevel: "soft-mandatory",
+				Result: "failed"},
+			{Name: "tags", PolicySet: "networking", Kind: "sentinel", EnforcementLevel: "soft-mandatory",
+				Result: "passed"},
+			{Name: "deny-destroy", PolicySet: "opa-set", Kind: "opa", EnforcementLevel: "mandatory", Result: "failed"},
+			{Name: "require-tags", PolicySet: "opa-set", Kind: "opa", EnforcementLevel: "advisory", Result: "passed"},
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("unexpected results:\n\t%v\nexpected\n\t%v", results, expected)
+		}
+
+		metadata := make(map[string]string)
+		for _, m := range policyMetadata(results) {
+			metadata[m.Name] = m.Value
+		}
+		if metadata["policies_passed"] != "2" || metadata["policies_failed"] != "2" ||
+			metadata["policies_advisory_failed"] != "1" {
+			t.Errorf("unexpected policy metadata: %v", metadata)
+		}
+	})
+	t.Run("error listing policy checks", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+
+		if _, err := r.getPolicyResults(&run); didntErrorWithSubstr(err, "error listing policy checks: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error listing task stages", func(t *testing.T) {
+		r, run := setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+
+		if _, err := r.getPolicyResults(&run); didntErrorWithSubstr(err, "error listing task stages: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error listing policy outcomes", func(t *testing.T) {
+		r, run := setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.TaskStageList{Items: []*tfe.TaskStage{
+			{ID: "ts-1", PolicyEvaluations: []*tfe.PolicyEvaluation{{ID: "poleval-1"}}},
+		}}, nil)
+		r.policyOutcomes.EXPECT().List(gomock.Any(), "poleval-1", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+
+		if _, err := r.getPolicyResults(&run); didntErrorWithSubstr(err, "error listing policy outcomes: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestOverridePolicies(t *testing.T) {
+	input := inputJSON{Params: paramsJSON{OverridePolicies: true, OverrideJustification: "approved by release"}}
+
+	t.Run("sentinel and opa overrides", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+
+		r.comments.EXPECT().Create(gomock.Any(), "run-bar", tfe.CommentCreateOptions{Body: "approved by release"}).
+			Return(&tfe.Comment{}, nil)
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.PolicyCheckList{Items: []*tfe.PolicyCheck{
+			{ID: "polchk-1", Status: tfe.PolicySoftFailed, Actions: &tfe.PolicyActions{IsOverridable: true}},
+			{ID: "polchk-2", Status: tfe.PolicyPasses, Actions: &tfe.PolicyActions{IsOverridable: false}},
+		}}, nil)
+		r.policyChecks.EXPECT().Override(gomock.Any(), "polchk-1").Return(&tfe.PolicyCheck{}, nil)
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.TaskStageList{Items: []*tfe.TaskStage{
+			{ID: "ts-1", Status: tfe.TaskStagePassed},
+			{ID: "ts-2", Status: tfe.TaskStageAwaitingOverride},
+		}}, nil)
+		r.taskStages.EXPECT().Override(gomock.Any(), "ts-2", gomock.Any()).DoAndReturn(
+			func(_ interface{}, _ string, o tfe.TaskStageOverrideOptions) (*tfe.TaskStage, error) {
+				if o.Comment == nil || *o.Comment != "approved by release" {
+					t.Errorf("task stage override didn't include justification: %v", o.Comment)
+				}
+				return &tfe.TaskStage{}, nil
+			})
+
+		if err := r.overridePolicies(input, &run); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("nothing to override", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+
+		// the justification isn't left on the run when nothing can be overridden
+		r.comments.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.PolicyCheckList{Items: []*tfe.PolicyCheck{
+			{ID: "polchk-1", Status: tfe.PolicySoftFailed, Actions: &tfe.PolicyActions{IsOverridable: false}},
+		}}, nil)
+
+		if err := r.overridePolicies(input, &run); didntErrorWithSubstr(err, "no soft-failed policies could be overridden") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error commenting", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.PolicyCheckList{Items: []*tfe.PolicyCheck{
+			{ID: "polchk-1", Status: tfe.PolicySoftFailed, Actions: &tfe.PolicyActions{IsOverridable: true}},
+		}}, nil)
+		r.comments.EXPECT().Create(gomock.Any(), "run-bar", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+		r.policyChecks.EXPECT().Override(gomock.Any(), gomock.Any()).Times(0)
+
+		if err := r.overridePolicies(input, &run); didntErrorWithSubstr(err, "error commenting on run: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error overriding", func(t *testing.T) {
+		r, run := setup(t)
+		run.PolicyChecks = []*tfe.PolicyCheck{{ID: "polchk-1"}}
+
+		r.comments.EXPECT().Create(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.Comment{}, nil)
+		r.policyChecks.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(&tfe.PolicyCheckList{Items: []*tfe.PolicyCheck{
+			{ID: "polchk-1", Status: tfe.PolicySoftFailed, Actions: &tfe.PolicyActions{IsOverridable: true}},
+		}}, nil)
+		r.policyChecks.EXPECT().Override(gomock.Any(), "polchk-1").Return(nil, fmt.Errorf("NO"))
+
+		if err := r.overridePolicies(input, &run); didntErrorWithSubstr(err, "error overriding policy check: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
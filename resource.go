@@ -0,0 +1,224 @@
+package concourse_tfe_resource
+
+import (
+	"context"
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type (
+	// Resource runs the check, in and out steps against a single workspace. The zero value connects using the source
+	// configuration of the first request, and later requests must have the same address, organization and workspace.
+	// Set Client and Workspace to use an existing connection instead.
+	Resource struct {
+		Client    Client
+		Workspace *tfe.Workspace
+		Context   context.Context
+		Logger    *log.Logger
+		// files are read from and written to paths relative to this directory
+		WorkingDirectory string
+		// filters, formats and redacts Logger's output, once the source configuration has been read
+		logs *logWriter
+		// the source configuration startup connected with, or nil if Client and Workspace were set by the caller
+		connected *sourceJSON
+	}
+
+	// Client holds the Terraform Cloud API services used by the resource, narrowed to the methods it calls
+	Client struct {
+		Workspaces            WorkspacesAPI
+		Runs                  RunsAPI
+		Variables             VariablesAPI
+		StateVersions         StateVersionsAPI
+		ConfigurationVersions ConfigurationVersionsAPI
+		PolicyChecks          PolicyChecksAPI
+		TaskStages            TaskStagesAPI
+		PolicySetOutcomes     PolicySetOutcomesAPI
+		Comments              CommentsAPI
+		CostEstimates         CostEstimatesAPI
+		Plans                 PlansAPI
+	}
+
+	WorkspacesAPI interface {
+		Read(ctx context.Context, organization string, workspace string) (*tfe.Workspace, error)
+	}
+	RunsAPI interface {
+		List(ctx context.Context, workspaceID string, options *tfe.RunListOptions) (*tfe.RunList, error)
+		Read(ctx context.Context, runID string) (*tfe.Run, error)
+		ReadWithOptions(ctx context.Context, runID string, options *tfe.RunReadOptions) (*tfe.Run, error)
+		Create(ctx context.Context, options tfe.RunCreateOptions) (*tfe.Run, error)
+		Apply(ctx context.Context, runID string, options tfe.RunApplyOptions) error
+		Discard(ctx context.Context, runID string, options tfe.RunDiscardOptions) error
+		Cancel(ctx context.Context, runID string, options tfe.RunCancelOptions) error
+	}
+	VariablesAPI interface {
+		List(ctx context.Context, workspaceID string, options *tfe.VariableListOptions) (*tfe.VariableList, error)
+		Create(ctx context.Context, workspaceID string, options tfe.VariableCreateOptions) (*tfe.Variable, error)
+		Update(ctx context.Context, workspaceID string, variableID string,
+			options tfe.VariableUpdateOptions) (*tfe.Variable, error)
+	}
+	StateVersionsAPI interface {
+		List(ctx context.Context, options *tfe.StateVersionListOptions) (*tfe.StateVersionList, error)
+		ReadCurrent(ctx context.Context, workspaceID string) (*tfe.StateVersion, error)
+		ReadCurrentWithOptions(ctx context.Context, workspaceID string,
+			options *tfe.StateVersionCurrentOptions) (*tfe.StateVersion, error)
+		Download(ctx context.Context, url string) ([]byte, error)
+	}
+	ConfigurationVersionsAPI interface {
+		ReadWithOptions(ctx context.Context, cvID string,
+			options *tfe.ConfigurationVersionReadOptions) (*tfe.ConfigurationVersion, error)
+		Download(ctx context.Context, cvID string) ([]byte, error)
+	}
+	PolicyChecksAPI interface {
+		List(ctx context.Context, runID string, options *tfe.PolicyCheckListOptions) (*tfe.PolicyCheckList, error)
+		Override(ctx context.Context, policyCheckID string) (*tfe.PolicyCheck, error)
+	}
+	TaskStagesAPI interface {
+		List(ctx context.Context, runID string, options *tfe.TaskStageListOptions) (*tfe.TaskStageList, error)
+		Read(ctx context.Context, taskStageID string, options *tfe.TaskStageReadOptions) (*tfe.TaskStage, error)
+		Override(ctx context.Context, taskStageID string, options tfe.TaskStageOverrideOptions) (*tfe.TaskStage, error)
+	}
+	PolicySetOutcomesAPI interface {
+		List(ctx context.Context, policyEvaluationID string,
+			options *tfe.PolicySetOutcomeListOptions) (*tfe.PolicySetOutcomeList, error)
+	}
+	CommentsAPI interface {
+		Create(ctx context.Context, runID string, options tfe.CommentCreateOptions) (*tfe.Comment, error)
+	}
+	CostEstimatesAPI interface {
+		Read(ctx context.Context, costEstimateID string) (*tfe.CostEstimate, error)
+	}
+	PlansAPI interface {
+		Read(ctx context.Context, planID string) (*tfe.Plan, error)
+		ReadJSONOutput(ctx context.Context, planID string) ([]byte, error)
+		Logs(ctx context.Context, planID string) (io.Reader, error)
+	}
+)
+
+// NewClient narrows a go-tfe client to the services used by the resource
+func NewClient(client *tfe.Client) Client {
+	return Client{
+		Workspaces:            client.Workspaces,
+		Runs:                  client.Runs,
+		Variables:             client.Variables,
+		StateVersions:         client.StateVersions,
+		ConfigurationVersions: client.ConfigurationVersions,
+		PolicyChecks:          client.PolicyChecks,
+		TaskStages:            client.TaskStages,
+		PolicySetOutcomes:     client.PolicySetOutcomes,
+		Comments:              client.Comments,
+		CostEstimates:         client.CostEstimates,
+		Plans:                 client.Plans,
+	}
+}
+
+// Check lists the workspace's runs, given a check request as described in the Concourse resource documentation
+func (r *Resource) Check(request io.Reader) ([]byte, error) {
+	input, err := r.prepare(request)
+	if err != nil {
+		return nil, err
+	}
+	return r.check(input)
+}
+
+// In fetches a run and the workspace's variables and outputs into the working directory
+func (r *Resource) In(request io.Reader) ([]byte, error) {
+	input, err := r.prepare(request)
+	if err != nil {
+		return nil, err
+	}
+	return r.in(input)
+}
+
+// Out pushes variables and queues a run, or acts on a run fetched into the working directory
+func (r *Resource) Out(request io.Reader) ([]byte, error) {
+	input, err := r.prepare(request)
+	if err != nil {
+		return nil, err
+	}
+	return r.out(input)
+}
+
+func (r *Resource) prepare(request io.Reader) (inputJSON, error) {
+	if r.Context == nil {
+		r.Context = context.Background()
+	}
+	if r.Logger == nil {
+		r.Logger = log.Default()
+	}
+	input, err := getInputs(request, r.Logger)
+	if err != nil {
+		return input, err
+	}
+	r.configureLogging(input.Source)
+	if r.Workspace == nil {
+		if err := r.startup(input); err != nil {
+			return input, err
+		}
+		r.connected = &input.Source
+	} else if c := r.connected; c != nil && !c.sameWorkspace(input.Source) {
+		return input, fmt.Errorf("error in source configuration: resource is already connected to %s/%s at %s",
+			c.Organization, c.Workspace, c.Address)
+	}
+	return input, nil
+}
+
+// sameWorkspace is true if both sources refer to the same workspace on the same server
+func (s sourceJSON) sameWorkspace(other sourceJSON) bool {
+	return s.Address == other.Address && s.Organization == other.Organization && s.Workspace == other.Workspace
+}
+
+func (r *Resource) startup(input inputJSON) error {
+	if r.Client.Workspaces == nil {
+		transport, err := input.Source.httpTransport(r.Logger)
+		if err != nil {
+			return formatError(err, "configuring http client")
+		}
+		// the address was validated with the rest of the source configuration
+		address, _ := url.Parse(input.Source.Address)
+		var base http.RoundTripper = transport
+		if r.debugging() {
+			base = &traceTransport{base: transport, logger: r.Logger, apiHost: address.Host}
+		}
+		httpClient := &http.Client{Transport: &retryTransport{
+			base:    base,
+			policy:  input.Source.Retry,
+			logger:  r.Logger,
+			apiHost: address.Host,
+		}}
+		if input.Source.WorkloadIdentity != nil {
+			r.redact(input.Source.WorkloadIdentity.IDToken)
+		}
+		token, err := input.Source.apiToken(r.Context, httpClient)
+		if err != nil {
+			return formatError(err, "getting api token")
+		}
+		r.redact(token)
+		config := &tfe.Config{
+			Token:      token,
+			Address:    input.Source.Address,
+			Headers:    make(http.Header),
+			HTTPClient: httpClient,
+		}
+		for name, value := range input.Source.Headers {
+			config.Headers.Set(name, value)
+		}
+		client, err := tfe.NewClient(config)
+		if err != nil {
+			return formatError(err, "creating tfe client")
+		}
+		r.Client = NewClient(client)
+	}
+
+	var err error
+	r.Workspace, err = r.Client.Workspaces.Read(r.Context,
+		input.Source.Organization,
+		input.Source.Workspace)
+	if err != nil {
+		return formatError(err, "getting workspace")
+	}
+	return nil
+}
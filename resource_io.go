@@ -8,19 +8,44 @@ import (
 	tfe "github.com/hashicorp/go-tfe"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 )
 
 type (
 	version struct {
 		Ref string `json:"ref"`
+		// only set if they're chosen with version_fields
+		CreatedAt string `json:"created_at,omitempty"`
+		Source    string `json:"source,omitempty"`
+		CommitSHA string `json:"commit_sha,omitempty"`
 	}
 	sourceJSON struct {
 		Workspace    string `json:"workspace"`
 		Organization string `json:"organization"`
 		Token        string `json:"token"`
-		Address      string `json:"address"`
+		// alternatives to token, which keep it out of the pipeline configuration
+		TokenFile        string                `json:"token_file"`
+		TokenEnv         string                `json:"token_env"`
+		WorkloadIdentity *workloadIdentityJSON `json:"workload_identity"`
+		Address          string                `json:"address"`
+		Retry            retryJSON             `json:"retry"`
+		// PEM encoded, so they can come straight from a credential manager
+		CACert             string            `json:"ca_cert"`
+		ClientCert         string            `json:"client_cert"`
+		ClientKey          string            `json:"client_key"`
+		InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+		ProxyURL           string            `json:"proxy_url"`
+		Headers            map[string]string `json:"headers"`
+		LogLevel           string            `json:"log_level"`
+		LogFormat          string            `json:"log_format"`
+		// how many runs the first check returns, before there's a version to check from
+		InitialVersions int `json:"initial_versions"`
+		// fields added to each version alongside ref
+		VersionFields []string `json:"version_fields"`
 	}
 	inputJSON struct {
 		Params  paramsJSON `json:"params"`
@@ -38,26 +63,52 @@ type (
 	}
 	outOutputJSON inOutputJSON
 	paramsJSON    struct {
-		Vars          map[string]variableJSON `json:"vars"`
-		Message       string                  `json:"message"`
-		Confirm       bool                    `json:"confirm"`
-		PollingPeriod int                     `json:"polling_period"`
-		Sensitive     bool                    `json:"sensitive"`
-		ApplyMessage  string                  `json:"apply_message"`
+		Vars                  map[string]variableJSON `json:"vars"`
+		Message               string                  `json:"message"`
+		Confirm               bool                    `json:"confirm"`
+		PollingPeriod         int                     `json:"polling_period"`
+		Sensitive             bool                    `json:"sensitive"`
+		ApplyMessage          string                  `json:"apply_message"`
+		VariablesFile         string                  `json:"variables_file"`
+		OutputFormats         []string                `json:"output_formats"`
+		Outputs               outputFilterJSON        `json:"outputs"`
+		DownloadState         bool                    `json:"download_state"`
+		DownloadConfig        bool                    `json:"download_config"`
+		OverridePolicies      bool                    `json:"override_policies"`
+		OverrideJustification string                  `json:"override_justification"`
+		FailOnRunTasks        []string                `json:"fail_on_run_tasks"`
+		MaxMonthlyCostDelta   *float64                `json:"max_monthly_cost_delta"`
+		Guardrails            guardrailsJSON          `json:"guardrails"`
+		Action                string                  `json:"action"`
+		Run                   string                  `json:"run"`
+		DiscardMessage        string                  `json:"discard_message"`
+		CancelPending         bool                    `json:"cancel_pending"`
+		WaitFor               string                  `json:"wait_for"`
+		// MessageTemplate is the message as configured, before interpolation. It's used to recognise runs queued by
+		// other builds of the job.
+		MessageTemplate string `json:"-"`
 	}
+	outputFilterJSON struct {
+		Include []string          `json:"include"`
+		Exclude []string          `json:"exclude"`
+		Rename  map[string]string `json:"rename"`
+	}
+	// pointer fields are nil when omitted, so existing settings are left alone on update
 	variableJSON struct {
-		File        string           `json:"file"`
-		Value       string           `json:"value"`
-		Description string           `json:"description"`
-		Category    tfe.CategoryType `json:"category"`
-		Sensitive   bool             `json:"sensitive"`
-		Hcl         bool             `json:"hcl"`
+		File             string           `json:"file"`
+		Value            string           `json:"value"`
+		Description      *string          `json:"description"`
+		Category         tfe.CategoryType `json:"category"`
+		Sensitive        *bool            `json:"sensitive"`
+		Hcl              *bool            `json:"hcl"`
+		AllowUnsensitive bool             `json:"allow_unsensitive"`
+		Interpolate      bool             `json:"interpolate"`
 	}
 )
 
-func (v variableJSON) UnmarshalJSON(b []byte) error {
+func (v *variableJSON) UnmarshalJSON(b []byte) error {
 	type VJ variableJSON
-	var vj = (*VJ)(&v)
+	var vj = (*VJ)(v)
 	vj.Category = tfe.CategoryTerraform
 	if err := json.Unmarshal(b, vj); err != nil {
 		return err
@@ -69,15 +120,24 @@ func (v variableJSON) UnmarshalJSON(b []byte) error {
 	return errors.New("invalid variable type")
 }
 
-func getInputs(in io.Reader) (inputJSON, error) {
+func getInputs(in io.Reader, logger *log.Logger) (inputJSON, error) {
 	input := inputJSON{}
 	input.Source = sourceJSON{
-		Address: "https://app.terraform.io",
+		Address:         "https://app.terraform.io",
+		InitialVersions: 1,
+		Retry: retryJSON{
+			MaxAttempts: 5,
+			MinBackoff:  1,
+			MaxBackoff:  30,
+			Jitter:      true,
+			GracePeriod: 300,
+		},
 	}
 	input.Params = paramsJSON{
-		Message:       "Queued by ${pipeline}/${job} (${number})",
-		PollingPeriod: 5,
-		Sensitive:     false,
+		Message:        "Queued by ${pipeline}/${job} (${number})",
+		DiscardMessage: "Discarded by ${pipeline}/${job} (${number})",
+		PollingPeriod:  5,
+		Sensitive:      false,
 	}
 
 	decoder := json.NewDecoder(in)
@@ -86,73 +146,232 @@ func getInputs(in io.Reader) (inputJSON, error) {
 	if err := decoder.Decode(&input); err != nil {
 		return input, formatError(err, "parsing input")
 	}
+	input.Params.MessageTemplate = input.Params.Message
 
 	// a few sanity checks
-	if !validateInput(&input) {
+	if !validateInput(&input, logger) {
 		return input, fmt.Errorf("invalid configuration provided")
 	}
 	return input, nil
 }
 
-func validateInput(input *inputJSON) (validConfig bool) {
+func validateInput(input *inputJSON, logger *log.Logger) (validConfig bool) {
 	validConfig = true
 
 	message, err := parseMessage(input.Params.ApplyMessage)
 	input.Params.ApplyMessage = message
 	if err != nil {
-		log.Printf("error in source configuration: invalid apply message (%s)", err)
+		logger.Printf("error in source configuration: invalid apply message (%s)", err)
 		validConfig = false
 	}
 	message, err = parseMessage(input.Params.Message)
 	input.Params.Message = message
 	if err != nil {
-		log.Printf("error in source configuration: invalid run message (%s)", err)
+		logger.Printf("error in source configuration: invalid run message (%s)", err)
+		validConfig = false
+	} else if input.Params.CancelPending {
+		if _, err := messagePattern(input.Params.MessageTemplate); err != nil {
+			logger.Printf("error in parameter value: cancel_pending can't recognise runs by their message (%s)", err)
+			validConfig = false
+		}
+	}
+	message, err = parseMessage(input.Params.DiscardMessage)
+	input.Params.DiscardMessage = message
+	if err != nil {
+		logger.Printf("error in source configuration: invalid discard message (%s)", err)
+		validConfig = false
+	}
+	message, err = parseMessage(input.Params.OverrideJustification)
+	input.Params.OverrideJustification = message
+	if err != nil {
+		logger.Printf("error in source configuration: invalid override justification (%s)", err)
+		validConfig = false
+	} else if input.Params.OverridePolicies && message == "" {
+		logger.Print("error in parameter value: override_policies requires an override_justification")
 		validConfig = false
 	}
 	if _, err := url.ParseRequestURI(input.Source.Address); err != nil {
-		log.Printf("error in source configuration: \"%v\" is not a valid URL", input.Source.Address)
+		logger.Printf("error in source configuration: \"%v\" is not a valid URL", input.Source.Address)
 		validConfig = false
 	}
 	if input.Source.Workspace == "" {
-		log.Print("error in source configuration: workspace is not set")
+		logger.Print("error in source configuration: workspace is not set")
 		validConfig = false
 	}
 	if input.Source.Organization == "" {
-		log.Print("error in source configuration: organization is not set")
+		logger.Print("error in source configuration: organization is not set")
+		validConfig = false
+	}
+	if sources := input.Source.tokenSources(); len(sources) == 0 {
+		logger.Print("error in source configuration: token is not set (set one of token, token_file, token_env " +
+			"or workload_identity)")
+		validConfig = false
+	} else if len(sources) > 1 {
+		logger.Printf("error in source configuration: only one token source can be set, but found %s",
+			strings.Join(sources, ", "))
+		validConfig = false
+	}
+	if identity := input.Source.WorkloadIdentity; identity != nil {
+		if _, err := url.ParseRequestURI(identity.ExchangeURL); err != nil {
+			logger.Printf("error in source configuration: \"%v\" is not a valid exchange_url",
+				identity.ExchangeURL)
+			validConfig = false
+		}
+		if (identity.IDToken == "") == (identity.IDTokenFile == "") {
+			logger.Print("error in source configuration: workload_identity needs exactly one of id_token and " +
+				"id_token_file")
+			validConfig = false
+		}
+	}
+	if (input.Source.ClientCert == "") != (input.Source.ClientKey == "") {
+		logger.Print("error in source configuration: client_cert and client_key must be set together")
+		validConfig = false
+	}
+	if input.Source.ProxyURL != "" {
+		if _, err := url.ParseRequestURI(input.Source.ProxyURL); err != nil {
+			logger.Printf("error in source configuration: \"%v\" is not a valid proxy URL", input.Source.ProxyURL)
+			validConfig = false
+		}
+	}
+	for name := range input.Source.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			logger.Print("error in source configuration: the Authorization header is set from token")
+			validConfig = false
+		}
+	}
+	if _, ok := logLevels[input.Source.LogLevel]; !ok && input.Source.LogLevel != "" {
+		logger.Printf("error in source configuration: \"%s\" is not a log level (use debug, info, warn or error)",
+			input.Source.LogLevel)
+		validConfig = false
+	}
+	switch input.Source.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		logger.Printf("error in source configuration: \"%s\" is not a log format (use text or json)",
+			input.Source.LogFormat)
+		validConfig = false
+	}
+	for _, field := range input.Source.VersionFields {
+		switch field {
+		case versionFieldCreatedAt, versionFieldSource, versionFieldCommitSHA:
+		default:
+			logger.Printf("error in source configuration: \"%s\" is not a version field (use created_at, source "+
+				"or commit_sha)", field)
+			validConfig = false
+		}
+	}
+	if input.Source.InitialVersions < 1 {
+		logger.Print("error in source configuration: initial_versions must be at least 1")
 		validConfig = false
 	}
-	if input.Source.Token == "" {
-		log.Print("error in source configuration: token is not set")
+	retry := input.Source.Retry
+	if retry.MaxAttempts < 1 {
+		logger.Print("error in source configuration: retry.max_attempts must be at least 1")
+		validConfig = false
+	}
+	if retry.MinBackoff <= 0 || retry.MaxBackoff < retry.MinBackoff {
+		logger.Print("error in source configuration: retry backoff must be positive, and min_backoff can't be more " +
+			"than max_backoff")
+		validConfig = false
+	}
+	if retry.GracePeriod < 0 {
+		logger.Print("error in source configuration: retry.grace_period can't be negative")
 		validConfig = false
 	}
 	if input.Params.PollingPeriod < 1 {
-		log.Print("error in parameter value: polling_period must be at least 1 second")
+		logger.Print("error in parameter value: polling_period must be at least 1 second")
+		validConfig = false
+	}
+	if input.Params.DownloadState && !input.Params.Sensitive {
+		logger.Print("error in parameter value: download_state requires sensitive to be true, since the state " +
+			"contains every sensitive value in the workspace")
+		validConfig = false
+	}
+	var patterns []string
+	patterns = append(patterns, input.Params.Outputs.Include...)
+	patterns = append(patterns, input.Params.Outputs.Exclude...)
+	patterns = append(patterns, input.Params.Guardrails.ForbidDestroyTypes...)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logger.Printf("error in parameter value: \"%s\" is not a valid pattern", pattern)
+			validConfig = false
+		}
+	}
+	guardrails := input.Params.Guardrails
+	if (guardrails.MaxDestroy != nil && *guardrails.MaxDestroy < 0) ||
+		(guardrails.MaxChanges != nil && *guardrails.MaxChanges < 0) {
+		logger.Print("error in parameter value: guardrail limits can't be negative")
+		validConfig = false
+	}
+	for from, to := range input.Params.Outputs.Rename {
+		if to == "" || to == "." || to == ".." || strings.Contains(to, "/") {
+			logger.Printf("error in parameter value: can't rename output \"%s\" to \"%s\"", from, to)
+			validConfig = false
+		}
+	}
+	for _, level := range input.Params.FailOnRunTasks {
+		if level != string(tfe.Mandatory) && level != string(tfe.Advisory) {
+			logger.Printf("error in parameter value: \"%s\" is not a run task enforcement level", level)
+			validConfig = false
+		}
+	}
+	switch input.Params.Action {
+	case "":
+	case actionDiscard, actionApply:
+		if input.Params.Run == "" {
+			logger.Printf("error in parameter value: the %s action requires run", input.Params.Action)
+			validConfig = false
+		}
+	default:
+		logger.Printf("error in parameter value: \"%s\" is not a valid action", input.Params.Action)
 		validConfig = false
 	}
+	if input.Params.WaitFor != "" && input.Params.WaitFor != waitForPlanned {
+		logger.Printf("error in parameter value: \"%s\" is not a valid wait_for state", input.Params.WaitFor)
+		validConfig = false
+	} else if input.Params.WaitFor == waitForPlanned && input.Params.Confirm {
+		logger.Print("error in parameter value: confirm can't be used with wait_for: planned")
+		validConfig = false
+	}
+	for _, format := range input.Params.OutputFormats {
+		if !validOutputFormat(format) {
+			logger.Printf("error in parameter value: \"%s\" is not a valid output format", format)
+			validConfig = false
+		}
+	}
 	return validConfig
 }
 
 func parseMessage(message string) (string, error) {
-	return envsubst.Eval(message, func(varName string) string {
-		envVar := "NONEXISTENT_VALUE"
-		switch varName {
-		case "id":
-			envVar = "BUILD_ID"
-		case "number":
-			envVar = "BUILD_NAME"
-		case "job":
-			envVar = "BUILD_JOB_NAME"
-		case "pipeline":
-			envVar = "BUILD_PIPELINE_NAME"
-		case "team":
-			envVar = "BUILD_TEAM_NAME"
-		case "url":
-			envVar = "ATC_EXTERNAL_URL"
-		}
-		return os.Getenv(envVar)
-	})
+	return envsubst.Eval(message, messageVariable)
 }
 
+func messageVariable(varName string) string {
+	envVar := "NONEXISTENT_VALUE"
+	switch varName {
+	case "id":
+		envVar = "BUILD_ID"
+	case "number":
+		envVar = "BUILD_NAME"
+	case "job":
+		envVar = "BUILD_JOB_NAME"
+	case "pipeline":
+		envVar = "BUILD_PIPELINE_NAME"
+	case "team":
+		envVar = "BUILD_TEAM_NAME"
+	case "url":
+		envVar = "ATC_EXTERNAL_URL"
+	}
+	return os.Getenv(envVar)
+}
+
+// formatError says what the resource was doing when err happened, explaining common API errors
 func formatError(err error, context string) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		if apiErr = classifyError(err, context); apiErr != nil {
+			return apiErr
+		}
+	}
 	return fmt.Errorf("error %s: %w", context, err)
 }
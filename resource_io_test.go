@@ -3,6 +3,7 @@ package concourse_tfe_resource
 import (
 	"bytes"
 	"encoding/json"
+	"github.com/hashicorp/go-tfe"
 	"log"
 	"os"
 	"strings"
@@ -12,25 +13,45 @@ import (
 func TestGetInput(t *testing.T) {
 	input := inputJSON{
 		Params: paramsJSON{
-			PollingPeriod: -1,
-			Message:       "Hiya ${fdkj",
-			ApplyMessage:  "${missingbrace",
+			PollingPeriod:    -1,
+			Message:          "Hiya ${fdkj",
+			ApplyMessage:     "${missingbrace",
+			OutputFormats:    []string{"yaml", "xml"},
+			DownloadState:    true,
+			OverridePolicies: true,
+			FailOnRunTasks:   []string{"mandatory", "optional"},
+			Outputs: outputFilterJSON{
+				Include: []string{"[unclosed"},
+				Rename:  map[string]string{"foo": "bar/baz", "up": ".."},
+			},
+			Guardrails: guardrailsJSON{MaxDestroy: tfe.Int(-1)},
+			Action:     "destroy",
+			WaitFor:    "applied",
 		},
 		Source: sourceJSON{
-			Workspace:    "",
-			Organization: "",
-			Token:        "",
-			Address:      "",
+			Workspace:        "",
+			Organization:     "",
+			Token:            "",
+			Address:          "",
+			Retry:            retryJSON{MaxAttempts: 0, MinBackoff: 10, MaxBackoff: 1, GracePeriod: -1},
+			TokenEnv:         "TFE_TOKEN",
+			WorkloadIdentity: &workloadIdentityJSON{ExchangeURL: "not a url"},
+			ClientCert:       "cert",
+			ProxyURL:         "not a url",
+			LogLevel:         "verbose",
+			LogFormat:        "xml",
+			VersionFields:    []string{"created_at", "status"},
+			Headers:          map[string]string{"authorization": "Bearer other"},
 		},
 		Version: version{
 			Ref: "",
 		},
 	}
 	var logOutput bytes.Buffer
-	log.SetOutput(&logOutput)
+	logger := log.New(&logOutput, "", 0)
 
 	inputBytes, _ := json.Marshal(input)
-	_, err := getInputs(bytes.NewReader(inputBytes))
+	_, err := getInputs(bytes.NewReader(inputBytes), logger)
 
 	if err == nil {
 		t.Error("accepted bad input")
@@ -50,30 +71,175 @@ func TestGetInput(t *testing.T) {
 		if !bytes.Contains(logOutput.Bytes(), []byte("organization is not set")) {
 			t.Error("didn't complain about empty organization")
 		}
-		if !bytes.Contains(logOutput.Bytes(), []byte("token is not set")) {
-			t.Error("didn't complain about empty token")
+		if !bytes.Contains(logOutput.Bytes(), []byte("only one token source can be set, but found token_env, "+
+			"workload_identity")) {
+			t.Error("didn't complain about several token sources")
 		}
 		if !bytes.Contains(logOutput.Bytes(), []byte("must be at least 1 second")) {
 			t.Error("didn't complain about bad polling_period")
 		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("override_policies requires an override_justification")) {
+			t.Error("didn't complain about overriding without a justification")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"optional\" is not a run task enforcement level")) {
+			t.Error("didn't complain about bad run task level")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("download_state requires sensitive")) {
+			t.Error("didn't complain about downloading state without sensitive")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"xml\" is not a valid output format")) {
+			t.Error("didn't complain about bad output format")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"[unclosed\" is not a valid pattern")) {
+			t.Error("didn't complain about bad output pattern")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("can't rename output \"foo\" to \"bar/baz\"")) {
+			t.Error("didn't complain about bad output rename")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("can't rename output \"up\" to \"..\"")) {
+			t.Error("didn't complain about bad output rename")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("guardrail limits can't be negative")) {
+			t.Error("didn't complain about negative guardrail")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"not a url\" is not a valid exchange_url")) {
+			t.Error("didn't complain about bad exchange_url")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("workload_identity needs exactly one of id_token and")) {
+			t.Error("didn't complain about missing id token")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("client_cert and client_key must be set together")) {
+			t.Error("didn't complain about client_cert without client_key")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"not a url\" is not a valid proxy URL")) {
+			t.Error("didn't complain about bad proxy_url")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("the Authorization header is set from token")) {
+			t.Error("didn't complain about overriding the Authorization header")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"verbose\" is not a log level")) {
+			t.Error("didn't complain about bad log_level")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"xml\" is not a log format")) {
+			t.Error("didn't complain about bad log_format")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("retry.max_attempts must be at least 1")) {
+			t.Error("didn't complain about bad max_attempts")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("initial_versions must be at least 1")) {
+			t.Error("didn't complain about bad initial_versions")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"status\" is not a version field")) ||
+			bytes.Contains(logOutput.Bytes(), []byte("\"created_at\" is not a version field")) {
+			t.Error("didn't complain about just the bad version field")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("min_backoff can't be more than max_backoff")) {
+			t.Error("didn't complain about bad backoff")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("retry.grace_period can't be negative")) {
+			t.Error("didn't complain about negative grace_period")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"destroy\" is not a valid action")) {
+			t.Error("didn't complain about bad action")
+		}
+		if !bytes.Contains(logOutput.Bytes(), []byte("\"applied\" is not a valid wait_for state")) {
+			t.Error("didn't complain about bad wait_for")
+		}
 	}
 
 	input.Source.Address = "https://foo.bar"
 	input.Source.Workspace = "workspace"
 	input.Source.Organization = "org"
 	input.Source.Token = "token"
+	input.Source.TokenEnv = ""
+	input.Source.WorkloadIdentity = nil
+	input.Source.Retry = retryJSON{MaxAttempts: 3, MinBackoff: 0.5, MaxBackoff: 10, GracePeriod: 60}
+	input.Source.InitialVersions = 10
+	input.Source.VersionFields = []string{"created_at", "commit_sha"}
+	input.Source.ClientKey = "key"
+	input.Source.ProxyURL = "http://proxy.internal:3128"
+	input.Source.Headers = map[string]string{"X-Team": "platform"}
+	input.Source.LogLevel = "debug"
+	input.Source.LogFormat = logFormatJSON
 	input.Params.PollingPeriod = 4
 	input.Params.ApplyMessage = "Applying!"
 	input.Params.Message = "Queued by a thing!"
+	input.Params.OutputFormats = []string{"yaml"}
+	input.Params.Sensitive = true
+	input.Params.OverrideJustification = "Approved in ${pipeline}"
+	input.Params.FailOnRunTasks = []string{"mandatory"}
+	input.Params.Outputs = outputFilterJSON{Include: []string{"vpc_*"}, Rename: map[string]string{"vpc_id": "id"}}
+	input.Params.Guardrails = guardrailsJSON{MaxDestroy: tfe.Int(0), ForbidDestroyTypes: []string{"aws_db_*"}}
+	input.Params.Action = ""
+	input.Params.WaitFor = ""
 	logOutput.Reset()
 	inputBytes, _ = json.Marshal(input)
-	_, err = getInputs(bytes.NewReader(inputBytes))
+	_, err = getInputs(bytes.NewReader(inputBytes), logger)
 	if err != nil {
 		t.Error("returned error with valid config")
 	}
 
+	input.Source.Token = ""
+	logOutput.Reset()
+	inputBytes, _ = json.Marshal(input)
+	if _, err = getInputs(bytes.NewReader(inputBytes), logger); err == nil {
+		t.Error("accepted config without a token")
+	}
+	if !bytes.Contains(logOutput.Bytes(), []byte("token is not set")) {
+		t.Error("didn't complain about empty token")
+	}
+	input.Source.Token = "token"
+
+	input.Source.Retry.MinBackoff = 0
+	logOutput.Reset()
+	inputBytes, _ = json.Marshal(input)
+	if _, err = getInputs(bytes.NewReader(inputBytes), logger); err == nil {
+		t.Error("accepted config without a backoff")
+	}
+	if !bytes.Contains(logOutput.Bytes(), []byte("retry backoff must be positive")) {
+		t.Error("didn't complain about zero min_backoff")
+	}
+	input.Source.Retry.MinBackoff = 0.5
+
+	input.Params.WaitFor = waitForPlanned
+	input.Params.Confirm = true
+	logOutput.Reset()
+	inputBytes, _ = json.Marshal(input)
+	if _, err = getInputs(bytes.NewReader(inputBytes), logger); err == nil {
+		t.Error("accepted confirm with wait_for: planned")
+	}
+	if !bytes.Contains(logOutput.Bytes(), []byte("confirm can't be used with wait_for: planned")) {
+		t.Error("didn't complain about confirming while waiting for a plan")
+	}
+
+	input.Params.Confirm = false
+	input.Params.WaitFor = ""
+	input.Params.CancelPending = true
+	input.Params.Message = "${number}"
+	logOutput.Reset()
+	inputBytes, _ = json.Marshal(input)
+	if _, err = getInputs(bytes.NewReader(inputBytes), logger); err == nil {
+		t.Error("accepted cancel_pending with a message matching any run")
+	}
+	if !bytes.Contains(logOutput.Bytes(), []byte("cancel_pending can't recognise runs by their message")) {
+		t.Error("didn't complain about a message which can't identify the job's runs")
+	}
+
+	input.Params.CancelPending = false
+	input.Params.Message = "Queued by a thing!"
+	input.Params.WaitFor = waitForPlanned
+	input.Params.Action = actionDiscard
+	logOutput.Reset()
+	inputBytes, _ = json.Marshal(input)
+	if _, err = getInputs(bytes.NewReader(inputBytes), logger); err == nil {
+		t.Error("accepted discard action without a run")
+	}
+	if !bytes.Contains(logOutput.Bytes(), []byte("the discard action requires run")) {
+		t.Error("didn't complain about discarding without a run")
+	}
+
 	inputBytes = []byte(`{"params":{"bnoggle":"farf"},"version":{"ref":"foo"}}`)
-	_, err = getInputs(bytes.NewReader(inputBytes))
+	_, err = getInputs(bytes.NewReader(inputBytes), logger)
 	if err == nil || !strings.Contains(err.Error(), "bnoggle") {
 		t.Error("didn't complain about invalid field")
 	}
@@ -90,6 +256,20 @@ func TestVariableJSON_UnmarshalJSON(t *testing.T) {
 	if err := v.UnmarshalJSON([]byte(`{}`)); err != nil {
 		t.Errorf("expected no error, got %s", err)
 	}
+
+	var vars map[string]variableJSON
+	if err := json.Unmarshal([]byte(`{"a":{"value":"x","hcl":false},"b":{"value":"y"}}`), &vars); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if vars["a"].Value != "x" || vars["a"].Hcl == nil || *vars["a"].Hcl {
+		t.Errorf("explicit fields weren't decoded: %+v", vars["a"])
+	}
+	if vars["b"].Hcl != nil || vars["b"].Sensitive != nil || vars["b"].Description != nil {
+		t.Errorf("omitted fields should be unset: %+v", vars["b"])
+	}
+	if vars["b"].Category != tfe.CategoryTerraform {
+		t.Errorf("category should default to terraform, got %s", vars["b"].Category)
+	}
 }
 
 func TestParseMessage(t *testing.T) {
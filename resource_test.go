@@ -0,0 +1,81 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"strings"
+	"testing"
+)
+
+const testRequest = `{"source":{"workspace":"ws","organization":"org","token":"token"},"version":{"ref":"run-1"}}`
+
+func TestResourceCheck(t *testing.T) {
+	r, _ := setup(t)
+	r.Context = nil
+	r.Logger = nil
+	r.runs.EXPECT().Read(gomock.Any(), "run-1").Return(&tfe.Run{ID: "run-1"}, nil)
+	r.runs.EXPECT().List(gomock.Any(), "foo", gomock.Any()).Return(&tfe.RunList{Items: []*tfe.Run{{ID: "run-1"}}}, nil)
+
+	output, err := r.Check(strings.NewReader(testRequest))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(output) != `[{"ref":"run-1"}]` {
+		t.Errorf("unexpected output %s", output)
+	}
+	if r.Context == nil || r.Logger == nil {
+		t.Error("defaults weren't set")
+	}
+}
+
+func TestResourceStartup(t *testing.T) {
+	t.Run("reads the workspace with an existing client", func(t *testing.T) {
+		r, run := setup(t)
+		r.Workspace = nil
+		r.workspaces.EXPECT().Read(gomock.Any(), "org", "ws").Return(&tfe.Workspace{ID: "ws-1"}, nil)
+		r.runs.EXPECT().Create(gomock.Any(), gomock.Any()).Return(&run, nil)
+		r.variables.EXPECT().List(gomock.Any(), "ws-1", gomock.Any()).Return(&tfe.VariableList{}, nil)
+
+		if _, err := r.Out(strings.NewReader(testRequest)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if r.Workspace.ID != "ws-1" {
+			t.Errorf("workspace wasn't set")
+		}
+	})
+	t.Run("refuses a different workspace once connected", func(t *testing.T) {
+		r, _ := setup(t)
+		r.Workspace = nil
+		r.workspaces.EXPECT().Read(gomock.Any(), "org", "ws").Return(&tfe.Workspace{ID: "ws-1"}, nil)
+		r.runs.EXPECT().Read(gomock.Any(), "run-1").Return(&tfe.Run{ID: "run-1"}, nil).Times(2)
+		r.runs.EXPECT().List(gomock.Any(), "ws-1", gomock.Any()).
+			Return(&tfe.RunList{Items: []*tfe.Run{{ID: "run-1"}}}, nil).Times(2)
+
+		if _, err := r.Check(strings.NewReader(testRequest)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := r.Check(strings.NewReader(testRequest)); err != nil {
+			t.Errorf("unexpected error with the same source: %s", err)
+		}
+		other := strings.Replace(testRequest, `"workspace":"ws"`, `"workspace":"other"`, 1)
+		if _, err := r.Check(strings.NewReader(other)); didntErrorWithSubstr(err,
+			"resource is already connected to org/ws at https://app.terraform.io") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("error reading workspace", func(t *testing.T) {
+		r, _ := setup(t)
+		r.Workspace = nil
+		r.workspaces.EXPECT().Read(gomock.Any(), "org", "ws").Return(nil, fmt.Errorf("NO"))
+		if _, err := r.In(strings.NewReader(testRequest)); didntErrorWithSubstr(err, "error getting workspace: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	t.Run("invalid request", func(t *testing.T) {
+		r, _ := setup(t)
+		if _, err := r.In(strings.NewReader(`{"source":{}}`)); didntErrorWithSubstr(err, "invalid configuration") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type (
+	// retryJSON is the retry policy for every API request, and how long polling tolerates requests that fail anyway
+	retryJSON struct {
+		MaxAttempts int `json:"max_attempts"`
+		// backoff doubles from min_backoff up to max_backoff, in seconds
+		MinBackoff  float64 `json:"min_backoff"`
+		MaxBackoff  float64 `json:"max_backoff"`
+		Jitter      bool    `json:"jitter"`
+		GracePeriod int     `json:"grace_period"`
+	}
+
+	// retryTransport retries requests which were rate limited, and idempotent requests which failed with a server or
+	// network error. Other requests aren't retried, since the server may have acted on them.
+	retryTransport struct {
+		base   http.RoundTripper
+		policy retryJSON
+		logger *log.Logger
+		// the host of the Terraform Cloud address, whose API paths are safe to log
+		apiHost string
+	}
+
+	// retryError is returned once a request has failed max_attempts times
+	retryError struct {
+		attempts int
+		err      error
+	}
+)
+
+const (
+	headerRetryAfter     = "Retry-After"
+	headerRateLimitReset = "X-RateLimit-Reset"
+)
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts: %s", e.attempts, e.err)
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	getBody, err := rewindableBody(req)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if getBody != nil {
+			attemptReq = req.Clone(req.Context())
+			if attemptReq.Body, err = getBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := t.base.RoundTrip(attemptReq)
+		if !t.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		failure := err
+		if resp != nil {
+			failure = errors.New(resp.Status)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if attempt >= t.policy.MaxAttempts {
+			return nil, &retryError{attempts: attempt, err: failure}
+		}
+
+		wait := t.policy.backoff(attempt, resp)
+		t.logger.Printf("%s %s failed (%s), retrying in %s (attempt %d of %d)",
+			req.Method, logTarget(req.URL, t.apiHost), failure, wait.Round(time.Millisecond), attempt+1, t.policy.MaxAttempts)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if req.Method == http.MethodPost {
+		return false
+	}
+	if err != nil {
+		// TLS failures aren't going to go away by themselves. crypto/tls reports alerts from the server, like a
+		// missing client certificate, as a "remote error".
+		var (
+			certErr *tls.CertificateVerificationError
+			opErr   *net.OpError
+		)
+		return !errors.As(err, &certErr) && !(errors.As(err, &opErr) && opErr.Op == "remote error")
+	}
+	return resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented
+}
+
+// rewindableBody returns a function which gives a fresh copy of the request body for each attempt
+func rewindableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}, nil
+}
+
+// backoff is how long to wait before the next attempt. If the server said when to try again, it waits that long;
+// otherwise the wait doubles with each attempt, with jitter taking up to half of it off to spread out retries.
+func (p retryJSON) backoff(attempt int, resp *http.Response) time.Duration {
+	if wait, ok := serverBackoff(resp); ok {
+		return wait
+	}
+	seconds := math.Min(p.MinBackoff*math.Pow(2, float64(attempt-1)), p.MaxBackoff)
+	if p.Jitter {
+		seconds -= rand.Float64() * seconds / 2
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// serverBackoff reads Retry-After, as seconds or a date, or else Terraform Cloud's X-RateLimit-Reset, which is the
+// number of seconds until the rate limit resets
+func serverBackoff(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if value := resp.Header.Get(headerRetryAfter); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			if wait := time.Until(date); wait > 0 {
+				return wait, true
+			}
+			return 0, true
+		}
+	}
+	if value := resp.Header.Get(headerRateLimitReset); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+// transient errors are those the retry policy gave up on, which may succeed given more time
+func transient(err error) bool {
+	var retryErr *retryError
+	return errors.As(err, &retryErr)
+}
@@ -0,0 +1,149 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/hashicorp/go-tfe"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	var (
+		statuses []int
+		bodies   []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.Header().Set(headerRetryAfter, "0")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	var logOutput bytes.Buffer
+	client := &http.Client{Transport: &retryTransport{
+		base:    http.DefaultTransport,
+		policy:  retryJSON{MaxAttempts: 3},
+		logger:  log.New(&logOutput, "", 0),
+		apiHost: strings.TrimPrefix(server.URL, "http://"),
+	}}
+
+	statuses = []int{http.StatusTooManyRequests, http.StatusTooManyRequests}
+	resp, err := client.Post(server.URL+"/api/v2/runs?token=secret", "text/plain", strings.NewReader("body"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("rate limited request wasn't retried: %v / %s", resp, err)
+	}
+	if strings.Join(bodies, ",") != "body,body,body" {
+		t.Errorf("request body wasn't resent: %v", bodies)
+	}
+	expected := "POST /api/v2/runs failed (429 Too Many Requests), retrying in 0s (attempt 2 of 3)"
+	if !strings.Contains(logOutput.String(), expected) {
+		t.Errorf("retry wasn't logged: %s", logOutput.String())
+	}
+
+	statuses = []int{http.StatusServiceUnavailable}
+	resp, err = client.Post(server.URL, "text/plain", nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || len(statuses) != 0 {
+		t.Errorf("POST was retried after a server error: %v / %s", resp, err)
+	}
+
+	statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	resp, err = client.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET wasn't retried after a server error: %v / %s", resp, err)
+	}
+
+	statuses = []int{http.StatusNotFound}
+	resp, err = client.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusNotFound || len(statuses) != 0 {
+		t.Errorf("GET was retried after a client error: %v / %s", resp, err)
+	}
+
+	statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+	_, err = client.Get(server.URL)
+	if didntErrorWithSubstr(err, "giving up after 3 attempts: 502 Bad Gateway") || !transient(err) {
+		t.Errorf("expected transient error after 3 attempts, got %s", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := retryJSON{MinBackoff: 1, MaxBackoff: 5}
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second,
+		4: 5 * time.Second} {
+		if wait := policy.backoff(attempt, nil); wait != expected {
+			t.Errorf("attempt %d waited %s, expected %s", attempt, wait, expected)
+		}
+	}
+
+	policy.Jitter = true
+	for i := 0; i < 20; i++ {
+		if wait := policy.backoff(3, nil); wait < 2*time.Second || wait > 4*time.Second {
+			t.Errorf("jittered wait %s is out of range", wait)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(headerRateLimitReset, "0.25")
+	if wait := policy.backoff(1, resp); wait != 250*time.Millisecond {
+		t.Errorf("didn't wait for the rate limit reset, waited %s", wait)
+	}
+	resp.Header.Set(headerRetryAfter, "7")
+	if wait := policy.backoff(1, resp); wait != 7*time.Second {
+		t.Errorf("didn't wait for Retry-After seconds, waited %s", wait)
+	}
+	resp.Header.Set(headerRetryAfter, time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait := policy.backoff(1, resp); wait < 58*time.Second || wait > time.Minute {
+		t.Errorf("didn't wait for Retry-After date, waited %s", wait)
+	}
+}
+
+func TestRetryPolling(t *testing.T) {
+	fake := newFakeTFE(t)
+	run := fake.addRun("TestRetryPolling", tfe.RunApplying, tfe.RunApplied)
+	dir := path.Join("test_output", "test_retry_polling")
+	_ = os.RemoveAll(dir)
+	_ = os.MkdirAll(dir, os.FileMode(0755))
+
+	// the first poll gives up after max_attempts, but the run is read again within the grace period
+	fake.failures["GET workspaces runs"] = []int{http.StatusTooManyRequests}
+	input := inputJSON{
+		Source:  fake.source(),
+		Params:  paramsJSON{PollingPeriod: 1},
+		Version: version{Ref: run.ID},
+	}
+	byteInput, _ := json.Marshal(input)
+	if _, err := realMain([]string{"check"}, bytes.NewReader(byteInput)); err != nil {
+		t.Errorf("check failed after being rate limited: %s", err)
+	}
+	fake.failures["GET runs"] = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway,
+		http.StatusServiceUnavailable}
+	if _, err := realMain([]string{"in", dir}, bytes.NewReader(byteInput)); err != nil {
+		t.Errorf("in failed with transient errors: %s", err)
+	}
+	if status := fake.runs[0].run.Status; status != tfe.RunApplied {
+		t.Errorf("run finished as %s, expected applied", status)
+	}
+
+	// without a grace period, the first transient error fails the step
+	fake.failures["GET runs"] = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+	input.Source.Retry.GracePeriod = 0
+	byteInput, _ = json.Marshal(input)
+	_, err := realMain([]string{"in", dir}, bytes.NewReader(byteInput))
+	var retryErr *retryError
+	if !errors.As(err, &retryErr) || retryErr.attempts != 3 {
+		t.Errorf("expected transient error without a grace period, got %s", err)
+	}
+}
@@ -0,0 +1,84 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"strings"
+)
+
+type runTaskJSON struct {
+	Stage            string `json:"stage"`
+	Name             string `json:"name"`
+	Status           string `json:"status"`
+	EnforcementLevel string `json:"enforcement_level"`
+	Message          string `json:"message"`
+	URL              string `json:"url"`
+}
+
+// getRunTasks returns the result of every run task attached to the run, across all task stages
+func (r *Resource) getRunTasks(run *tfe.Run) ([]runTaskJSON, error) {
+	tasks := []runTaskJSON{}
+	if len(run.TaskStages) == 0 {
+		return tasks, nil
+	}
+	stages, err := r.listTaskStages(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stages {
+		stage, err := r.Client.TaskStages.Read(r.Context, s.ID,
+			&tfe.TaskStageReadOptions{Include: []tfe.TaskStageIncludeOpt{tfe.TaskStageTaskResults}})
+		if err != nil {
+			return nil, formatError(err, "reading task stage")
+		}
+		for _, result := range stage.TaskResults {
+			tasks = append(tasks, runTaskJSON{
+				Stage:            string(stage.Stage),
+				Name:             result.TaskName,
+				Status:           string(result.Status),
+				EnforcementLevel: string(result.WorkspaceTaskEnforcementLevel),
+				Message:          result.Message,
+				URL:              result.URL,
+			})
+		}
+	}
+	return tasks, nil
+}
+
+// reportTaskStages logs task stages whose status has changed since the last poll
+func (r *Resource) reportTaskStages(run *tfe.Run, reported map[string]tfe.TaskStageStatus) error {
+	if len(run.TaskStages) == 0 {
+		return nil
+	}
+	stages, err := r.listTaskStages(run.ID)
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		if reported[stage.ID] != stage.Status {
+			r.Logger.Printf("Run tasks in %s stage: %s", stage.Stage, stage.Status)
+			reported[stage.ID] = stage.Status
+		}
+	}
+	return nil
+}
+
+// checkRunTasks returns an error describing each failed task with one of the given enforcement levels
+func checkRunTasks(tasks []runTaskJSON, levels []string) error {
+	var failures []string
+	for _, task := range tasks {
+		if task.Status != string(tfe.TaskFailed) && task.Status != string(tfe.TaskErrored) {
+			continue
+		}
+		for _, level := range levels {
+			if task.EnforcementLevel == level {
+				failures = append(failures, fmt.Sprintf("%s (%s, %s): %s",
+					task.Name, task.Stage, task.EnforcementLevel, task.Message))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("error checking run tasks: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
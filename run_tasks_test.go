@@ -0,0 +1,102 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/go-tfe"
+	"go.uber.org/mock/gomock"
+	"log"
+	"strings"
+	"testing"
+)
+
+func testTaskStage() *tfe.TaskStage {
+	return &tfe.TaskStage{
+		ID:    "ts-1",
+		Stage: tfe.PostPlan,
+		TaskResults: []*tfe.TaskResult{
+			{TaskName: "scanner", Status: tfe.TaskFailed, Message: "found 3 issues",
+				WorkspaceTaskEnforcementLevel: tfe.Advisory, URL: "https://scanner/1"},
+			{TaskName: "cost", Status: tfe.TaskPassed, WorkspaceTaskEnforcementLevel: tfe.Mandatory},
+		},
+	}
+}
+
+func TestGetRunTasks(t *testing.T) {
+	t.Run("no task stages", func(t *testing.T) {
+		r, run := setup(t)
+		if tasks, err := r.getRunTasks(&run); err != nil || tasks == nil || len(tasks) != 0 {
+			t.Errorf("unexpected result: %v / %s", tasks, err)
+		}
+	})
+	t.Run("task results", func(t *testing.T) {
+		r, run := setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(
+			&tfe.TaskStageList{Items: []*tfe.TaskStage{{ID: "ts-1"}}}, nil)
+		r.taskStages.EXPECT().Read(gomock.Any(), "ts-1", gomock.Any()).Return(testTaskStage(), nil)
+
+		tasks, err := r.getRunTasks(&run)
+		if err != nil || len(tasks) != 2 {
+			t.Fatalf("unexpected result: %v / %s", tasks, err)
+		}
+		expected := runTaskJSON{Stage: "post_plan", Name: "scanner", Status: "failed", EnforcementLevel: "advisory",
+			Message: "found 3 issues", URL: "https://scanner/1"}
+		if tasks[0] != expected {
+			t.Errorf("unexpected task: %v", tasks[0])
+		}
+	})
+	t.Run("error reading task stage", func(t *testing.T) {
+		r, run := setup(t)
+		run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+		r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Return(
+			&tfe.TaskStageList{Items: []*tfe.TaskStage{{ID: "ts-1"}}}, nil)
+		r.taskStages.EXPECT().Read(gomock.Any(), "ts-1", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+
+		if _, err := r.getRunTasks(&run); didntErrorWithSubstr(err, "error reading task stage: NO") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestReportTaskStages(t *testing.T) {
+	r, run := setup(t)
+	run.TaskStages = []*tfe.TaskStage{{ID: "ts-1"}}
+	statuses := []tfe.TaskStageStatus{tfe.TaskStageRunning, tfe.TaskStageRunning, tfe.TaskStagePassed}
+	call := 0
+	r.taskStages.EXPECT().List(gomock.Any(), "run-bar", gomock.Any()).Times(3).DoAndReturn(
+		func(_ interface{}, _ string, _ *tfe.TaskStageListOptions) (*tfe.TaskStageList, error) {
+			stage := &tfe.TaskStage{ID: "ts-1", Stage: tfe.PrePlan, Status: statuses[call]}
+			call++
+			return &tfe.TaskStageList{Items: []*tfe.TaskStage{stage}}, nil
+		})
+
+	var logOutput bytes.Buffer
+	r.Logger = log.New(&logOutput, "", 0)
+	reported := make(map[string]tfe.TaskStageStatus)
+	for range statuses {
+		if err := r.reportTaskStages(&run, reported); err != nil {
+			t.Error(err)
+		}
+	}
+	if strings.Count(logOutput.String(), "Run tasks in pre_plan stage") != 2 {
+		t.Errorf("expected one log line per status change, got:\n%s", logOutput.String())
+	}
+}
+
+func TestCheckRunTasks(t *testing.T) {
+	tasks := []runTaskJSON{
+		{Name: "scanner", Stage: "post_plan", Status: "failed", EnforcementLevel: "advisory", Message: "bad"},
+		{Name: "cost", Stage: "post_plan", Status: "passed", EnforcementLevel: "mandatory"},
+	}
+	if err := checkRunTasks(tasks, nil); err != nil {
+		t.Errorf("failed without any levels set: %s", err)
+	}
+	if err := checkRunTasks(tasks, []string{"mandatory"}); err != nil {
+		t.Errorf("failed on an advisory task: %s", err)
+	}
+	err := checkRunTasks(tasks, []string{"mandatory", "advisory"})
+	if didntErrorWithSubstr(err, "error checking run tasks: scanner (post_plan, advisory): bad") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -1,8 +1,9 @@
 package concourse_tfe_resource
 
 import (
-	"context"
+	"bytes"
 	"fmt"
+	slug "github.com/hashicorp/go-slug"
 	tfe "github.com/hashicorp/go-tfe"
 )
 
@@ -23,14 +24,21 @@ func finished(run *tfe.Run) bool {
 	return false
 }
 
-func needsConfirmation(run *tfe.Run) bool {
+// policiesSoftFailed is true when a run has stopped because of soft-mandatory policy failures. Sentinel failures stop
+// it in policy_override, and OPA failures in post_plan_awaiting_decision.
+func policiesSoftFailed(run *tfe.Run) bool {
+	return run.Status == tfe.RunPolicyOverride || run.Status == tfe.RunPolicySoftFailed ||
+		run.Status == tfe.RunPostPlanAwaitingDecision
+}
+
+func (r *Resource) needsConfirmation(run *tfe.Run) bool {
 	if !run.Actions.IsConfirmable {
 		// the run doesn't need confirmation
 		return false
 	} else if len(run.PolicyChecks) > 0 {
 		// if there are sentinel checks, we want to apply after they pass
 		return run.Status == tfe.RunPolicyChecked
-	} else if workspace.Organization.CostEstimationEnabled {
+	} else if r.Workspace.Organization.CostEstimationEnabled {
 		// otherwise if cost estimation is enabled, we want to confirm after the estimation
 		return run.Status == tfe.RunCostEstimated
 	} else {
@@ -55,17 +63,24 @@ func runMetadata(input inputJSON, run *tfe.Run) (metadata []versionMetadata) {
 		metadata = append(metadata, versionMetadata{Value: run.CostEstimate.DeltaMonthlyCost, Name: "cost_delta"})
 	}
 
-	// TODO add VCS source info if go-tfe ever supports it
 	metadata = append(metadata, versionMetadata{Value: string(run.ConfigurationVersion.Source), Name: "configuration_source"})
+	if run.ConfigurationVersion.ID != "" {
+		metadata = append(metadata, versionMetadata{Value: run.ConfigurationVersion.ID, Name: "configuration_version"})
+	}
+	if ia := run.ConfigurationVersion.IngressAttributes; ia != nil {
+		metadata = append(metadata, versionMetadata{Value: ia.CommitSHA, Name: "commit_sha"})
+		metadata = append(metadata, versionMetadata{Value: ia.Branch, Name: "branch"})
+		metadata = append(metadata, versionMetadata{Value: ia.CommitURL, Name: "commit_url"})
+	}
 
 	return
 }
 
-func getVariableList() (tfe.VariableList, error) {
+func (r *Resource) getVariableList() (tfe.VariableList, error) {
 	listOptions := tfe.VariableListOptions{ListOptions: tfe.ListOptions{PageSize: 100, PageNumber: 0}}
 	vars := tfe.VariableList{}
 	for {
-		newVars, err := client.Variables.List(context.Background(), workspace.ID, &listOptions)
+		newVars, err := r.Client.Variables.List(r.Context, r.Workspace.ID, &listOptions)
 		if err != nil {
 			return vars, formatError(err, "retrieving workspace variables")
 		}
@@ -77,17 +92,104 @@ func getVariableList() (tfe.VariableList, error) {
 	return vars, nil
 }
 
-func getWorkspaceOutputs() ([]*tfe.StateVersionOutput, error) {
+func (r *Resource) getWorkspaceOutputs() ([]*tfe.StateVersionOutput, error) {
 	var (
 		sv  *tfe.StateVersion
 		err error
 	)
-	if sv, err = client.StateVersions.ReadCurrentWithOptions(
-		context.Background(),
-		workspace.ID,
+	if sv, err = r.Client.StateVersions.ReadCurrentWithOptions(
+		r.Context,
+		r.Workspace.ID,
 		&tfe.StateVersionCurrentOptions{Include: []tfe.StateVersionIncludeOpt{tfe.SVoutputs}},
 	); err != nil {
 		return nil, formatError(err, "getting current workspace state")
 	}
 	return sv.Outputs, nil
 }
+
+// downloadRunState downloads the state version written by the run's apply, which is usually the current one. It
+// returns nil if the run didn't write any state.
+func (r *Resource) downloadRunState(input inputJSON, run *tfe.Run) ([]byte, error) {
+	sv, err := r.Client.StateVersions.ReadCurrent(r.Context, r.Workspace.ID)
+	if err != nil {
+		return nil, formatError(err, "getting current workspace state")
+	}
+	if sv.Run == nil || sv.Run.ID != run.ID {
+		if sv, err = r.findRunStateVersion(input, run); sv == nil {
+			return nil, err
+		}
+	}
+	state, err := r.Client.StateVersions.Download(r.Context, sv.DownloadURL)
+	if err != nil {
+		return nil, formatError(err, "downloading workspace state")
+	}
+	return state, nil
+}
+
+// findRunStateVersion looks through the workspace's state versions, newest first, for one written by the run. Any
+// written before the run was created can't be from it, so it stops there.
+func (r *Resource) findRunStateVersion(input inputJSON, run *tfe.Run) (*tfe.StateVersion, error) {
+	options := tfe.StateVersionListOptions{
+		ListOptions:  tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Organization: input.Source.Organization,
+		Workspace:    input.Source.Workspace,
+	}
+	for {
+		list, err := r.Client.StateVersions.List(r.Context, &options)
+		if err != nil {
+			return nil, formatError(err, "listing workspace state versions")
+		}
+		for _, sv := range list.Items {
+			if sv.Run != nil && sv.Run.ID == run.ID {
+				return sv, nil
+			}
+			if sv.CreatedAt.Before(run.CreatedAt) {
+				return nil, nil
+			}
+		}
+		if len(list.Items) == 0 || (list.Pagination != nil && list.Pagination.NextPage == 0) {
+			return nil, nil
+		}
+		options.PageNumber++
+	}
+}
+
+// getConfigurationVersion reads a configuration version along with its VCS details, which aren't included when
+// reading a run
+func (r *Resource) getConfigurationVersion(cvID string) (*tfe.ConfigurationVersion, error) {
+	cv, err := r.Client.ConfigurationVersions.ReadWithOptions(r.Context, cvID,
+		&tfe.ConfigurationVersionReadOptions{Include: []tfe.ConfigVerIncludeOpt{tfe.ConfigVerIngressAttributes}})
+	if err != nil {
+		return nil, formatError(err, "getting configuration version")
+	}
+	return cv, nil
+}
+
+func (r *Resource) downloadConfiguration(cvID string, dst string) error {
+	data, err := r.Client.ConfigurationVersions.Download(r.Context, cvID)
+	if err != nil {
+		return formatError(err, "downloading configuration version")
+	}
+	if err := slug.Unpack(bytes.NewReader(data), dst); err != nil {
+		return formatError(err, "unpacking configuration version")
+	}
+	return nil
+}
+
+func (r *Resource) listPolicyChecks(runID string) ([]*tfe.PolicyCheck, error) {
+	checks, err := r.Client.PolicyChecks.List(r.Context, runID,
+		&tfe.PolicyCheckListOptions{ListOptions: tfe.ListOptions{PageSize: 100}})
+	if err != nil {
+		return nil, formatError(err, "listing policy checks")
+	}
+	return checks.Items, nil
+}
+
+func (r *Resource) listTaskStages(runID string) ([]*tfe.TaskStage, error) {
+	stages, err := r.Client.TaskStages.List(r.Context, runID,
+		&tfe.TaskStageListOptions{ListOptions: tfe.ListOptions{PageSize: 100}})
+	if err != nil {
+		return nil, formatError(err, "listing task stages")
+	}
+	return stages.Items, nil
+}
@@ -6,15 +6,16 @@ import (
 	"go.uber.org/mock/gomock"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetWorkspaceOutputs(t *testing.T) {
 	t.Run("error getting workspace state version", func(t *testing.T) {
-		setup(t)
+		r, _ := setup(t)
 
-		stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+		r.stateVersions.EXPECT().ReadCurrentWithOptions(gomock.Any(), "foo", gomock.Any()).Return(nil, fmt.Errorf("NO"))
 
-		result, err := getWorkspaceOutputs()
+		result, err := r.getWorkspaceOutputs()
 
 		if result != nil || err == nil || !strings.Contains(err.Error(), "getting current workspace state") {
 			t.Errorf("didn't error about workspace state: %v %v", result, err)
@@ -22,22 +23,115 @@ func TestGetWorkspaceOutputs(t *testing.T) {
 	})
 }
 
+func TestDownloadRunState(t *testing.T) {
+	input := inputJSON{Source: sourceJSON{Organization: "org", Workspace: "ws"}}
+	run := &tfe.Run{ID: "run-1", CreatedAt: time.Now().Add(-time.Hour)}
+	listOptions := &tfe.StateVersionListOptions{ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Organization: "org", Workspace: "ws"}
+
+	t.Run("error getting workspace state version", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.stateVersions.EXPECT().ReadCurrent(gomock.Any(), "foo").Return(nil, fmt.Errorf("NO"))
+
+		result, err := r.downloadRunState(input, run)
+		if result != nil || didntErrorWithSubstr(err, "getting current workspace state") {
+			t.Errorf("didn't error about workspace state: %v %v", result, err)
+		}
+	})
+	t.Run("error downloading state", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.stateVersions.EXPECT().ReadCurrent(gomock.Any(), "foo").Return(
+			&tfe.StateVersion{DownloadURL: "/state", Run: run}, nil)
+		r.stateVersions.EXPECT().Download(gomock.Any(), "/state").Return(nil, fmt.Errorf("NO"))
+
+		result, err := r.downloadRunState(input, run)
+		if result != nil || didntErrorWithSubstr(err, "downloading workspace state") {
+			t.Errorf("didn't error about downloading state: %v %v", result, err)
+		}
+	})
+	t.Run("state written before a newer run", func(t *testing.T) {
+		r, _ := setup(t)
+
+		newer := &tfe.Run{ID: "run-2"}
+		r.stateVersions.EXPECT().ReadCurrent(gomock.Any(), "foo").Return(
+			&tfe.StateVersion{DownloadURL: "/current", Run: newer}, nil)
+		r.stateVersions.EXPECT().List(gomock.Any(), listOptions).Return(&tfe.StateVersionList{Items: []*tfe.StateVersion{
+			{DownloadURL: "/current", Run: newer, CreatedAt: time.Now()},
+			{DownloadURL: "/run-1", Run: run, CreatedAt: run.CreatedAt.Add(time.Minute)},
+		}}, nil)
+		r.stateVersions.EXPECT().Download(gomock.Any(), "/run-1").Return([]byte(`{"serial":1}`), nil)
+
+		result, err := r.downloadRunState(input, run)
+		if string(result) != `{"serial":1}` || err != nil {
+			t.Errorf("didn't download the run's state: %s %v", result, err)
+		}
+	})
+	t.Run("run didn't write state", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.stateVersions.EXPECT().ReadCurrent(gomock.Any(), "foo").Return(
+			&tfe.StateVersion{DownloadURL: "/current", Run: &tfe.Run{ID: "run-0"}}, nil)
+		// listing stops at the first state version older than the run
+		r.stateVersions.EXPECT().List(gomock.Any(), listOptions).Return(&tfe.StateVersionList{Items: []*tfe.StateVersion{
+			{DownloadURL: "/current", Run: &tfe.Run{ID: "run-0"}, CreatedAt: run.CreatedAt.Add(-time.Minute)},
+		}}, nil)
+
+		result, err := r.downloadRunState(input, run)
+		if result != nil || err != nil {
+			t.Errorf("expected no state: %s %v", result, err)
+		}
+	})
+}
+
+func TestConfigurationVersions(t *testing.T) {
+	t.Run("error reading configuration version", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.configVersions.EXPECT().ReadWithOptions(gomock.Any(), "cv-123", gomock.Any()).Return(nil, fmt.Errorf("NO"))
+
+		result, err := r.getConfigurationVersion("cv-123")
+		if result != nil || didntErrorWithSubstr(err, "getting configuration version") {
+			t.Errorf("didn't error about configuration version: %v %v", result, err)
+		}
+	})
+	t.Run("error downloading configuration version", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.configVersions.EXPECT().Download(gomock.Any(), "cv-123").Return(nil, fmt.Errorf("NO"))
+
+		if err := r.downloadConfiguration("cv-123", "nowhere"); didntErrorWithSubstr(err, "downloading configuration") {
+			t.Errorf("didn't error about downloading configuration: %v", err)
+		}
+	})
+	t.Run("error unpacking configuration version", func(t *testing.T) {
+		r, _ := setup(t)
+
+		r.configVersions.EXPECT().Download(gomock.Any(), "cv-123").Return([]byte("not a tarball"), nil)
+
+		if err := r.downloadConfiguration("cv-123", "nowhere"); didntErrorWithSubstr(err, "unpacking configuration") {
+			t.Errorf("didn't error about unpacking configuration: %v", err)
+		}
+	})
+}
+
 func TestNeedsConfirmation(t *testing.T) {
-	run := setup(t)
+	r, run := setup(t)
 
 	run.Actions.IsConfirmable = true
 	run.HasChanges = true
 	run.Status = tfe.RunPlanned
-	if !needsConfirmation(&run) {
+	if !r.needsConfirmation(&run) {
 		t.Error("run in planned with no cost estimation or policy returned false")
 	}
 
-	workspace.Organization.CostEstimationEnabled = true
-	if needsConfirmation(&run) {
+	r.Workspace.Organization.CostEstimationEnabled = true
+	if r.needsConfirmation(&run) {
 		t.Error("run in planned with cost estimates returned true")
 	}
 	run.Status = tfe.RunCostEstimated
-	if !needsConfirmation(&run) {
+	if !r.needsConfirmation(&run) {
 		t.Error("run in cost_estimated with cost estimates returned false")
 	}
 
@@ -45,11 +139,11 @@ func TestNeedsConfirmation(t *testing.T) {
 		{}, {},
 	}
 	run.Status = tfe.RunPlanned
-	if needsConfirmation(&run) {
+	if r.needsConfirmation(&run) {
 		t.Error("run in planned with policy checks returned true")
 	}
 	run.Status = tfe.RunPolicyChecked
-	if !needsConfirmation(&run) {
+	if !r.needsConfirmation(&run) {
 		t.Error("run in policy_checked with policy checks returned false")
 	}
 }
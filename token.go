@@ -0,0 +1,132 @@
+package concourse_tfe_resource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type (
+	// workloadIdentityJSON exchanges an OIDC id token, like the ones Concourse's idtoken var source provides, for a
+	// short-lived API token using OAuth 2.0 token exchange (RFC 8693)
+	workloadIdentityJSON struct {
+		ExchangeURL string `json:"exchange_url"`
+		IDToken     string `json:"id_token"`
+		IDTokenFile string `json:"id_token_file"`
+		Audience    string `json:"audience"`
+	}
+	tokenExchangeResponse struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenSources lists the token settings in use; validateInput makes sure there's exactly one
+func (s sourceJSON) tokenSources() (sources []string) {
+	if s.Token != "" {
+		sources = append(sources, "token")
+	}
+	if s.TokenFile != "" {
+		sources = append(sources, "token_file")
+	}
+	if s.TokenEnv != "" {
+		sources = append(sources, "token_env")
+	}
+	if s.WorkloadIdentity != nil {
+		sources = append(sources, "workload_identity")
+	}
+	return
+}
+
+// apiToken reads the token from wherever the source configuration says it is, using client for token exchange
+func (s sourceJSON) apiToken(ctx context.Context, client *http.Client) (string, error) {
+	switch {
+	case s.TokenFile != "":
+		return readTokenFile(s.TokenFile)
+	case s.TokenEnv != "":
+		token := strings.TrimSpace(os.Getenv(s.TokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("environment variable %s is empty", s.TokenEnv)
+		}
+		return token, nil
+	case s.WorkloadIdentity != nil:
+		return s.WorkloadIdentity.exchange(ctx, client)
+	}
+	return s.Token, nil
+}
+
+func readTokenFile(name string) (string, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return token, nil
+}
+
+func (w *workloadIdentityJSON) exchange(ctx context.Context, client *http.Client) (string, error) {
+	idToken := w.IDToken
+	if w.IDTokenFile != "" {
+		var err error
+		if idToken, err = readTokenFile(w.IDTokenFile); err != nil {
+			return "", err
+		}
+	}
+
+	form := url.Values{
+		"grant_type":           {grantTypeTokenExchange},
+		"subject_token":        {idToken},
+		"subject_token_type":   {tokenTypeIDToken},
+		"requested_token_type": {tokenTypeAccessToken},
+	}
+	if w.Audience != "" {
+		form.Set("audience", w.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.ExchangeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result tokenExchangeResponse
+	if err := json.Unmarshal(body, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("parsing exchange response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return "", fmt.Errorf("exchange endpoint returned %s: %s %s", resp.Status, result.Error, result.Description)
+		}
+		return "", fmt.Errorf("exchange endpoint returned %s", resp.Status)
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("exchange response didn't include an access_token")
+	}
+	return result.AccessToken, nil
+}
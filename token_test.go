@@ -0,0 +1,93 @@
+package concourse_tfe_resource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := path.Join(dir, "token")
+	_ = os.WriteFile(tokenFile, []byte("from-file\n"), 0600)
+	emptyFile := path.Join(dir, "empty")
+	_ = os.WriteFile(emptyFile, []byte("\n"), 0600)
+	t.Setenv("TFE_RESOURCE_TEST_TOKEN", "from-env")
+
+	tests := []struct {
+		source   sourceJSON
+		expected string
+		err      string
+	}{
+		{source: sourceJSON{Token: "literal"}, expected: "literal"},
+		{source: sourceJSON{TokenFile: tokenFile}, expected: "from-file"},
+		{source: sourceJSON{TokenFile: emptyFile}, err: "empty is empty"},
+		{source: sourceJSON{TokenFile: path.Join(dir, "missing")}, err: "no such file"},
+		{source: sourceJSON{TokenEnv: "TFE_RESOURCE_TEST_TOKEN"}, expected: "from-env"},
+		{source: sourceJSON{TokenEnv: "TFE_RESOURCE_TEST_UNSET"}, err: "TFE_RESOURCE_TEST_UNSET is empty"},
+	}
+	for _, test := range tests {
+		token, err := test.source.apiToken(context.Background(), http.DefaultClient)
+		if test.err != "" && didntErrorWithSubstr(err, test.err) {
+			t.Errorf("expected error containing %q for %+v, got %s", test.err, test.source, err)
+		} else if test.err == "" && (err != nil || token != test.expected) {
+			t.Errorf("expected %q for %+v, got %q / %s", test.expected, test.source, token, err)
+		}
+	}
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	fake := newFakeTFE(t)
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		if req.Form.Get("grant_type") != grantTypeTokenExchange ||
+			req.Form.Get("subject_token_type") != tokenTypeIDToken ||
+			req.Form.Get("audience") != "tfe" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		if req.Form.Get("subject_token") != "id-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"the id token has expired"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fakeToken, "expires_in": 900})
+	}))
+	defer exchange.Close()
+
+	source := fake.source()
+	source.Token = ""
+	source.WorkloadIdentity = &workloadIdentityJSON{ExchangeURL: exchange.URL, IDToken: "id-token", Audience: "tfe"}
+	r := &Resource{Context: context.Background()}
+	if err := r.startup(inputJSON{Source: source}); err != nil {
+		t.Errorf("startup failed with an exchanged token: %s", err)
+	}
+
+	source.WorkloadIdentity.IDToken = "expired"
+	r = &Resource{Context: context.Background()}
+	err := r.startup(inputJSON{Source: source})
+	if didntErrorWithSubstr(err, "error getting api token: exchange endpoint returned 401 Unauthorized: "+
+		"invalid_grant the id token has expired") {
+		t.Errorf("expected exchange error, got %s", err)
+	}
+
+	source.WorkloadIdentity.Audience = ""
+	_, err = source.apiToken(context.Background(), http.DefaultClient)
+	if didntErrorWithSubstr(err, "400 Bad Request: invalid_request") {
+		t.Errorf("expected bad request error, got %s", err)
+	}
+
+	idTokenFile := path.Join(t.TempDir(), "id_token")
+	_ = os.WriteFile(idTokenFile, []byte("id-token"), 0600)
+	// the fake API isn't an exchange endpoint, and its errors aren't in the OAuth format
+	source.WorkloadIdentity = &workloadIdentityJSON{ExchangeURL: fake.URL + "/exchange", IDTokenFile: idTokenFile}
+	_, err = source.apiToken(context.Background(), http.DefaultClient)
+	if err == nil || err.Error() != "exchange endpoint returned 401 Unauthorized" {
+		t.Errorf("expected unauthorized error, got %s", err)
+	}
+}
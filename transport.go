@@ -0,0 +1,49 @@
+package concourse_tfe_resource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// httpTransport builds the transport for API requests from the TLS and proxy settings in the source configuration
+func (s sourceJSON) httpTransport(logger *log.Logger) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if s.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(s.CACert)) {
+			return nil, errors.New("ca_cert doesn't contain any PEM encoded certificates")
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if s.ClientCert != "" {
+		certificate, err := tls.X509KeyPair([]byte(s.ClientCert), []byte(s.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("loading client_cert and client_key: %w", err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if s.InsecureSkipVerify {
+		logger.Print("WARNING: insecure_skip_verify is set, so the Terraform Enterprise server's certificate won't be " +
+			"checked. Anyone able to intercept traffic to it can read and change runs, variables and state, including " +
+			"the API token. Use ca_cert instead.")
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if s.ProxyURL != "" {
+		proxy, err := url.Parse(s.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
@@ -0,0 +1,133 @@
+package concourse_tfe_resource
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate generates a self-signed certificate, returning it and its key PEM encoded
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "concourse-tfe-resource test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestStartupTLS(t *testing.T) {
+	fake := newFakeTFE(t)
+	clientCert, clientKey := testCertificate(t)
+	clientPool := x509.NewCertPool()
+	clientPool.AppendCertsFromPEM([]byte(clientCert))
+
+	server := httptest.NewUnstartedServer(fake.Config.Handler)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	server.StartTLS()
+	defer server.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	var logOutput bytes.Buffer
+	startup := func(source sourceJSON) error {
+		r := &Resource{Context: context.Background(), Logger: log.New(&logOutput, "", 0)}
+		source.Address = server.URL
+		return r.startup(inputJSON{Source: source})
+	}
+
+	source := fake.source()
+	if err := startup(source); didntErrorWithSubstr(err, "certificate") {
+		t.Errorf("expected certificate error without ca_cert, got %s", err)
+	}
+	source.CACert = caCert
+	if err := startup(source); err == nil {
+		t.Error("connected without a client certificate")
+	}
+	if strings.Contains(logOutput.String(), "retrying") {
+		t.Errorf("retried after a TLS failure: %s", logOutput.String())
+	}
+	source.ClientCert, source.ClientKey = clientCert, clientKey
+	if err := startup(source); err != nil {
+		t.Errorf("startup failed with ca_cert and client certificate: %s", err)
+	}
+
+	source.CACert = ""
+	source.InsecureSkipVerify = true
+	if err := startup(source); err != nil {
+		t.Errorf("startup failed with insecure_skip_verify: %s", err)
+	}
+	if !strings.Contains(logOutput.String(), "WARNING: insecure_skip_verify is set") {
+		t.Error("didn't warn about insecure_skip_verify")
+	}
+
+	source.CACert = "not a certificate"
+	if err := startup(source); didntErrorWithSubstr(err, "ca_cert doesn't contain any PEM encoded certificates") {
+		t.Errorf("expected ca_cert error, got %s", err)
+	}
+	source.CACert = ""
+	source.ClientKey = clientCert
+	if err := startup(source); didntErrorWithSubstr(err, "loading client_cert and client_key") {
+		t.Errorf("expected client key error, got %s", err)
+	}
+}
+
+func TestStartupProxyHeaders(t *testing.T) {
+	fake := newFakeTFE(t)
+	fakeURL, _ := url.Parse(fake.URL)
+	var proxied []*http.Request
+	forward := httputil.NewSingleHostReverseProxy(fakeURL)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req)
+		forward.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	source := fake.source()
+	// the real host isn't used, since every request goes through the proxy
+	source.Address = "http://tfe.example.com"
+	source.ProxyURL = proxy.URL
+	source.Headers = map[string]string{"x-team": "platform"}
+	r := &Resource{Context: context.Background(), Logger: log.Default()}
+	if err := r.startup(inputJSON{Source: source}); err != nil {
+		t.Fatalf("startup failed through proxy: %s", err)
+	}
+
+	if len(proxied) == 0 {
+		t.Fatal("no requests went through the proxy")
+	}
+	for _, req := range proxied {
+		if req.Host != "tfe.example.com" || req.Header.Get("X-Team") != "platform" {
+			t.Errorf("unexpected proxied request to %s with headers %v", req.Host, req.Header)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package concourse_tfe_resource
+
+import (
+	"fmt"
+	tfe "github.com/hashicorp/go-tfe"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"path"
+	"strings"
+)
+
+// validateVars checks every variable before anything is pushed, so a typo fails the put instead of the plan
+func (r *Resource) validateVars(input inputJSON, list tfe.VariableList, values map[string]string) error {
+	var types map[string]cty.Type
+	if input.Params.VariablesFile != "" {
+		var err error
+		if types, err = readVariableTypes(path.Join(r.WorkingDirectory, input.Params.VariablesFile)); err != nil {
+			return err
+		}
+	}
+	for name, v := range input.Params.Vars {
+		// an omitted hcl flag leaves the existing variable's setting in place, so validate against that
+		if v.Hcl == nil {
+			existing := findVariable(list, name)
+			v.Hcl = tfe.Bool(existing != nil && existing.HCL)
+		}
+		if err := validateVar(name, v, values[name], types); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateVar(name string, v variableJSON, value string, types map[string]cty.Type) error {
+	val := cty.StringVal(value)
+	if v.Hcl != nil && *v.Hcl {
+		expr, diags := hclsyntax.ParseExpression([]byte(value), name, hcl.InitialPos)
+		if diags.HasErrors() {
+			return formatError(diags, "validating variable \""+name+"\"")
+		}
+		if val, diags = expr.Value(nil); diags.HasErrors() {
+			return formatError(diags, "validating variable \""+name+"\"")
+		}
+	}
+
+	ty, declared := types[name]
+	if v.Category == tfe.CategoryEnv || !declared {
+		return nil
+	}
+	if _, err := convert.Convert(val, ty); err != nil {
+		return fmt.Errorf("error validating variable \"%s\": value does not match type %s (%s)",
+			name, typeexpr.TypeString(ty), err)
+	}
+	return nil
+}
+
+// readVariableTypes returns the type constraint of each variable declared in a terraform file; variables without
+// a type constraint are omitted since they accept anything
+func readVariableTypes(fileName string) (map[string]cty.Type, error) {
+	var (
+		file  *hcl.File
+		diags hcl.Diagnostics
+	)
+	parser := hclparse.NewParser()
+	if strings.HasSuffix(fileName, ".json") {
+		file, diags = parser.ParseJSONFile(fileName)
+	} else {
+		file, diags = parser.ParseHCLFile(fileName)
+	}
+	if diags.HasErrors() {
+		return nil, formatError(diags, "parsing "+fileName)
+	}
+
+	content, _, diags := file.Body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+	})
+	if diags.HasErrors() {
+		return nil, formatError(diags, "reading variables from "+fileName)
+	}
+
+	types := make(map[string]cty.Type)
+	for _, block := range content.Blocks {
+		attrs, _, diags := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "type"}},
+		})
+		if diags.HasErrors() {
+			return nil, formatError(diags, "reading variables from "+fileName)
+		}
+		attr, ok := attrs.Attributes["type"]
+		if !ok {
+			continue
+		}
+		ty, diags := typeexpr.TypeConstraint(attr.Expr)
+		if diags.HasErrors() {
+			return nil, formatError(diags, "reading type of variable \""+block.Labels[0]+"\"")
+		}
+		types[block.Labels[0]] = ty
+	}
+	return types, nil
+}
@@ -0,0 +1,103 @@
+package concourse_tfe_resource
+
+import (
+	"github.com/hashicorp/go-tfe"
+	"os"
+	"path"
+	"testing"
+)
+
+const testVariablesFile = `
+variable "count" {
+  type = number
+}
+variable "tags" {
+  type = map(string)
+  validation {
+    condition     = length(var.tags) > 0
+    error_message = "need tags"
+  }
+}
+variable "anything" {}
+`
+
+func TestValidateVar(t *testing.T) {
+	t.Run("invalid hcl", func(t *testing.T) {
+		err := validateVar("broken", variableJSON{Hcl: tfe.Bool(true)}, "{ foo = ", nil)
+		if didntErrorWithSubstr(err, "error validating variable \"broken\": broken:1,") {
+			t.Errorf("expected a positioned parse error, got %s", err)
+		}
+	})
+	t.Run("hcl referencing other values", func(t *testing.T) {
+		err := validateVar("ref", variableJSON{Hcl: tfe.Bool(true)}, "var.foo", nil)
+		if didntErrorWithSubstr(err, "Variables not allowed") {
+			t.Errorf("expected evaluation error, got %s", err)
+		}
+	})
+	t.Run("valid hcl", func(t *testing.T) {
+		if err := validateVar("ok", variableJSON{Hcl: tfe.Bool(true)}, `{ foo = ["bar"] }`, nil); err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+	})
+	t.Run("plain values are not parsed", func(t *testing.T) {
+		if err := validateVar("ok", variableJSON{}, "{ foo = ", nil); err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+	})
+}
+
+func TestValidateVars(t *testing.T) {
+	wd, _ := os.Getwd()
+	r := &Resource{WorkingDirectory: path.Join(wd, "test_output", "test_validate_vars")}
+	_ = os.MkdirAll(r.WorkingDirectory, os.FileMode(0755))
+	_ = os.WriteFile(path.Join(r.WorkingDirectory, "variables.tf"), []byte(testVariablesFile), os.FileMode(0644))
+
+	input := inputJSON{Params: paramsJSON{
+		VariablesFile: "variables.tf",
+		Vars: map[string]variableJSON{
+			"count":    {},
+			"tags":     {Hcl: tfe.Bool(true)},
+			"anything": {Hcl: tfe.Bool(true)},
+			"COUNT":    {Category: tfe.CategoryEnv},
+		},
+	}}
+	list := tfe.VariableList{}
+	values := map[string]string{
+		"count":    "3",
+		"tags":     `{ team = "infra" }`,
+		"anything": `[1, "two"]`,
+		"COUNT":    "not a number",
+	}
+
+	if err := r.validateVars(input, list, values); err != nil {
+		t.Errorf("unexpected error validating matching values: %s", err)
+	}
+
+	values["count"] = "three"
+	if err := r.validateVars(input, list, values); didntErrorWithSubstr(err, "value does not match type number") {
+		t.Errorf("expected type error for count, got %s", err)
+	}
+
+	values["count"] = "3"
+	values["tags"] = `["infra"]`
+	if err := r.validateVars(input, list, values); didntErrorWithSubstr(err, "value does not match type map(string)") {
+		t.Errorf("expected type error for tags, got %s", err)
+	}
+
+	// an omitted hcl flag should fall back to the existing variable's setting
+	values["tags"] = `{ team = "infra" }`
+	values["anything"] = "{ unclosed"
+	input.Params.Vars["anything"] = variableJSON{}
+	if err := r.validateVars(input, list, values); err != nil {
+		t.Errorf("unexpected error validating a new non-HCL variable: %s", err)
+	}
+	list.Items = []*tfe.Variable{{Key: "anything", HCL: true}}
+	if err := r.validateVars(input, list, values); didntErrorWithSubstr(err, "error validating variable \"anything\"") {
+		t.Errorf("expected existing HCL variable to be parsed, got %s", err)
+	}
+
+	input.Params.VariablesFile = "missing.tf"
+	if err := r.validateVars(input, list, values); didntErrorWithSubstr(err, "error parsing ") {
+		t.Errorf("expected error reading variables file, got %s", err)
+	}
+}